@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/reconquest/hierr-go"
+)
+
+const authorizedKeysCacheDirName = "authorized_keys"
+
+// AuthorizedKeysCache stores SSH keys retrieved from shadowd for serving
+// them when shadowd servers are unreachable.
+type AuthorizedKeysCache struct {
+	dir string
+	ttl time.Duration
+}
+
+func NewAuthorizedKeysCache(
+	cacheDir string, ttl time.Duration,
+) *AuthorizedKeysCache {
+	return &AuthorizedKeysCache{
+		dir: filepath.Join(cacheDir, authorizedKeysCacheDirName),
+		ttl: ttl,
+	}
+}
+
+func (cache *AuthorizedKeysCache) getPath(pool, username string) string {
+	if pool == "" {
+		return filepath.Join(cache.dir, username)
+	}
+
+	return filepath.Join(cache.dir, pool, username)
+}
+
+// Get returns cached keys and reports whether cache is still fresh.
+func (cache *AuthorizedKeysCache) Get(
+	pool, username string,
+) ([]byte, bool, error) {
+	path := cache.getPath(pool, username)
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return contents, time.Since(stat.ModTime()) < cache.ttl, nil
+}
+
+func (cache *AuthorizedKeysCache) Set(
+	pool, username string, contents []byte,
+) error {
+	path := cache.getPath(pool, username)
+	dir := filepath.Dir(path)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't create cache directory %s", dir,
+		)
+	}
+
+	temporaryFile, err := ioutil.TempFile(dir, "."+username)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't create temporary file at %s", dir,
+		)
+	}
+	defer temporaryFile.Close()
+
+	_, err = temporaryFile.Write(contents)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't write temporary file %s", temporaryFile.Name(),
+		)
+	}
+
+	err = temporaryFile.Close()
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't close temporary file %s", temporaryFile.Name(),
+		)
+	}
+
+	err = os.Rename(temporaryFile.Name(), path)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't rename %s to %s", temporaryFile.Name(), path,
+		)
+	}
+
+	return nil
+}
+
+// handleAuthorizedKeysCommand prints SSH keys of specified user to stdout,
+// it is intended to be used as AuthorizedKeysCommand of sshd. Shadowd
+// servers are contacted only if cached keys are stale.
+func handleAuthorizedKeysCommand(args map[string]interface{}) error {
+	var (
+		username    = args["<user>"].(string)
+		pool, _     = args["--pool"].(string)
+		cacheDir    = args["--cache-dir"].(string)
+		rawCacheTTL = args["--cache-ttl"].(string)
+		rawTimeout  = args["--timeout"].(string)
+
+		revokedKeysPath, _ = args["--revoked-keys"].(string)
+	)
+
+	if username == "" {
+		return errors.New("username can't be empty")
+	}
+
+	if strings.Contains(username, "/") || strings.HasPrefix(username, ".") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+
+	cacheTTL, err := time.ParseDuration(rawCacheTTL)
+	if err != nil {
+		return hierr.Errorf(err, "invalid cache TTL %q", rawCacheTTL)
+	}
+
+	timeout, err := time.ParseDuration(rawTimeout)
+	if err != nil {
+		return hierr.Errorf(err, "invalid timeout %q", rawTimeout)
+	}
+
+	keyOptionsRules, keyPolicy, err := getSSHKeyRestrictions(args)
+	if err != nil {
+		return err
+	}
+
+	// revoked keys written by the last run of shadowc are applied even to
+	// cached keys, so revoked key can't be used until cache expires.
+	revokedKeys, err := readRevokedSSHKeysFile(revokedKeysPath)
+	if err != nil {
+		warningh(
+			err, "can't read revoked ssh keys from %s", revokedKeysPath,
+		)
+	}
+
+	cache := NewAuthorizedKeysCache(cacheDir, cacheTTL)
+
+	cached, fresh, err := cache.Get(pool, username)
+	if err != nil && !os.IsNotExist(err) {
+		warningh(err, "can't read cached ssh keys for %s", user{username, pool})
+	}
+
+	if cached != nil {
+		cached, err = removeRevokedSSHKeysFromContents(cached, revokedKeys)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't remove revoked ssh keys from cached keys of %s",
+				user{username, pool},
+			)
+		}
+	}
+
+	if fresh {
+		debugf("using cached ssh keys for %s", user{username, pool})
+
+		_, err = os.Stdout.Write(cached)
+		return err
+	}
+
+	keys, receivedRevokedKeys, err := getAuthorizedKeysWithDeadline(
+		args, pool, username, revokedKeysPath != "", timeout,
+	)
+	if err != nil {
+		if cached == nil {
+			return hierr.Errorf(
+				err, "can't retrieve ssh keys for %s and no cache available",
+				user{username, pool},
+			)
+		}
+
+		warningh(
+			err, "can't retrieve ssh keys for %s, using stale cache",
+			user{username, pool},
+		)
+
+		_, err = os.Stdout.Write(cached)
+		return err
+	}
+
+	keys, _ = keyOptionsRules.Apply(keys, pool)
+	keys, _ = keyPolicy.Filter(keys)
+	keys, _ = FilterExpiredSSHKeys(keys, time.Now())
+	keys, _ = FilterRevokedSSHKeys(
+		keys, append(revokedKeys, receivedRevokedKeys...),
+	)
+
+	contents := ""
+	for _, key := range keys[username] {
+		contents += key.Raw + "\n"
+	}
+
+	err = cache.Set(pool, username, []byte(contents))
+	if err != nil {
+		warningh(err, "can't cache ssh keys for %s", user{username, pool})
+	}
+
+	_, err = os.Stdout.WriteString(contents)
+	return err
+}
+
+// getAuthorizedKeysWithDeadline retrieves SSH keys of specified user and,
+// if requested, revoked keys of the pool, and returns error if all shadowd
+// servers are unreachable or if they did not respond in specified time. User
+// which is not known to shadowd servers has no keys. Shadowd client is
+// created within the same deadline, because resolving SRV records can hang
+// as well.
+func getAuthorizedKeysWithDeadline(
+	args map[string]interface{}, pool, username string, revoked bool,
+	timeout time.Duration,
+) (AuthorizedKeys, SSHKeys, error) {
+	type result struct {
+		keys        AuthorizedKeys
+		revokedKeys SSHKeys
+		err         error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		upstream, err := newShadowdUpstream(args)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+
+		upstream.SetTimeout(timeout)
+
+		keys, _, _, err := getAuthorizedKeys(
+			[]string{username}, upstream, pool,
+		)
+
+		var revokedKeys SSHKeys
+		if err == nil && revoked {
+			revokedKeys, err = getRevokedSSHKeys(upstream, pool)
+		}
+
+		if err == nil && !upstream.HasAliveShadowdHosts() {
+			err = errors.New("all shadowd servers has gone away")
+		}
+
+		done <- result{keys, revokedKeys, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.keys, result.revokedKeys, result.err
+
+	case <-time.After(timeout):
+		return nil, nil, fmt.Errorf(
+			"shadowd servers did not respond in %s", timeout,
+		)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reconquest/hierr-go"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	backupsDirName        = "backups"
+	backupManifestName    = "manifest.json"
+	backupTimestampFormat = "20060102T150405Z"
+
+	BackupKindShadow         = "shadow"
+	BackupKindAuthorizedKeys = "authorized_keys"
+	BackupKindPrincipals     = "principals"
+	BackupKindSSHKeys        = "ssh_keys"
+	BackupKindState          = "state"
+)
+
+// BackupFile is a copy of a single file made before the file was replaced.
+type BackupFile struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// Backup is a set of files which were replaced during one run of shadowc,
+// it is stored in its own directory named after the run timestamp.
+type Backup struct {
+	Timestamp string       `json:"timestamp"`
+	Files     []BackupFile `json:"files"`
+
+	dir string
+}
+
+// BackupStore keeps limited amount of the latest backups in the state
+// directory.
+type BackupStore struct {
+	dir  string
+	keep int
+}
+
+func NewBackupStore(stateDir string, keep int) *BackupStore {
+	return &BackupStore{
+		dir:  filepath.Join(stateDir, backupsDirName),
+		keep: keep,
+	}
+}
+
+// Create returns new empty backup, directory of the backup is created only
+// when the first file is added.
+func (store *BackupStore) Create() *Backup {
+	return &Backup{
+		Timestamp: time.Now().UTC().Format(backupTimestampFormat),
+		Files:     []BackupFile{},
+		dir:       store.dir,
+	}
+}
+
+// List returns all backups ordered from the oldest to the latest.
+func (store *BackupStore) List() ([]*Backup, error) {
+	paths, err := filepath.Glob(
+		filepath.Join(store.dir, "*", backupManifestName),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []*Backup{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err, "can't read backup manifest %s", path,
+			)
+		}
+
+		backup := &Backup{}
+
+		err = json.Unmarshal(data, backup)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err, "can't decode backup manifest %s", path,
+			)
+		}
+
+		backup.dir = filepath.Dir(path)
+
+		backups = append(backups, backup)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].isOlderThan(backups[j])
+	})
+
+	return backups, nil
+}
+
+// isOlderThan compares backups by timestamp and then by suffix, which is
+// added to backups made within the same second.
+func (backup *Backup) isOlderThan(another *Backup) bool {
+	timestamp, index := backup.splitTimestamp()
+	anotherTimestamp, anotherIndex := another.splitTimestamp()
+
+	if timestamp != anotherTimestamp {
+		return timestamp < anotherTimestamp
+	}
+
+	return index < anotherIndex
+}
+
+func (backup *Backup) splitTimestamp() (string, int) {
+	parts := strings.SplitN(backup.Timestamp, ".", 2)
+	if len(parts) == 1 {
+		return parts[0], 0
+	}
+
+	index, _ := strconv.Atoi(parts[1])
+
+	return parts[0], index
+}
+
+// Get returns backup with specified timestamp or the latest backup if
+// timestamp is empty.
+func (store *BackupStore) Get(timestamp string) (*Backup, error) {
+	backups, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backups found in %s", store.dir)
+	}
+
+	if timestamp == "" {
+		return backups[len(backups)-1], nil
+	}
+
+	for _, backup := range backups {
+		if backup.Timestamp == timestamp {
+			return backup, nil
+		}
+	}
+
+	return nil, fmt.Errorf("backup %s is not found", timestamp)
+}
+
+// Rotate removes the oldest backups, so only configured amount of backups
+// is kept.
+func (store *BackupStore) Rotate() error {
+	backups, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > store.keep {
+		debugf("removing backup %s", backups[0].Timestamp)
+
+		err = os.RemoveAll(backups[0].dir)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't remove backup %s", backups[0].dir,
+			)
+		}
+
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// Add stores copy of the file opened as source, which will be replaced at
+// specified path, along with its mode, owner and security attributes.
+func (backup *Backup) Add(path string, kind string, source *os.File) error {
+	if len(backup.Files) == 0 {
+		err := backup.createDir()
+		if err != nil {
+			return err
+		}
+	}
+
+	name := strconv.Itoa(len(backup.Files))
+	copyPath := filepath.Join(backup.dir, name)
+
+	_, err := source.Seek(0, io.SeekStart)
+	if err != nil {
+		return hierr.Errorf(err, "can't rewind %s", path)
+	}
+
+	file, err := os.OpenFile(
+		copyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|unix.O_NOFOLLOW, 0600,
+	)
+	if err != nil {
+		return hierr.Errorf(err, "can't create backup file %s", copyPath)
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, source)
+	if err == nil {
+		err = copyFileAttributes(source, file)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return hierr.Errorf(err, "can't copy %s to %s", path, copyPath)
+	}
+
+	_, err = source.Seek(0, io.SeekStart)
+	if err != nil {
+		return hierr.Errorf(err, "can't rewind %s", path)
+	}
+
+	backup.Files = append(backup.Files, BackupFile{
+		Path: path,
+		Kind: kind,
+		Name: name,
+	})
+
+	debugf("%s saved into backup %s", path, backup.Timestamp)
+
+	return backup.save()
+}
+
+// createDir creates directory of the backup, suffix is added to the
+// timestamp if there is already a backup made in the same second.
+func (backup *Backup) createDir() error {
+	err := os.MkdirAll(backup.dir, 0700)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't create backups directory %s", backup.dir,
+		)
+	}
+
+	timestamp := backup.Timestamp
+	for index := 1; ; index++ {
+		dir := filepath.Join(backup.dir, timestamp)
+
+		err = os.Mkdir(dir, 0700)
+		if err == nil {
+			backup.Timestamp = timestamp
+			backup.dir = dir
+
+			return nil
+		}
+
+		if !os.IsExist(err) {
+			return hierr.Errorf(
+				err, "can't create backup directory %s", dir,
+			)
+		}
+
+		timestamp = fmt.Sprintf("%s.%d", backup.Timestamp, index)
+	}
+}
+
+func (backup *Backup) save() error {
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return hierr.Errorf(err, "can't encode backup manifest")
+	}
+
+	temporaryFile, err := ioutil.TempFile(backup.dir, ".manifest")
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't create temporary file at %s", backup.dir,
+		)
+	}
+	defer temporaryFile.Close()
+
+	_, err = temporaryFile.Write(data)
+	if err == nil {
+		err = temporaryFile.Sync()
+	}
+	if err == nil {
+		err = temporaryFile.Close()
+	}
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't write temporary file %s", temporaryFile.Name(),
+		)
+	}
+
+	path := filepath.Join(backup.dir, backupManifestName)
+
+	err = os.Rename(temporaryFile.Name(), path)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't rename %s to %s", temporaryFile.Name(), path,
+		)
+	}
+
+	return nil
+}
+
+// Restore stages saved copies of every file of the backup into specified
+// transaction, so all files are replaced together when transaction is
+// committed. Shadow file is staged while holding shadow-utils lock.
+func (backup *Backup) Restore(transaction *Transaction) error {
+	for _, file := range backup.Files {
+		err := backup.stageFile(file, transaction)
+		if err != nil {
+			return hierr.Errorf(err, "can't restore %s", file.Path)
+		}
+	}
+
+	return nil
+}
+
+func (backup *Backup) stageFile(
+	file BackupFile, transaction *Transaction,
+) error {
+	if file.Kind == BackupKindShadow {
+		err := transaction.LockShadowFile(file.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	source, err := os.Open(filepath.Join(backup.dir, file.Name))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	var stat unix.Stat_t
+
+	err = unix.Fstat(int(source.Fd()), &stat)
+	if err != nil {
+		return hierr.Errorf(err, "can't stat %s", source.Name())
+	}
+
+	// directory is resolved without following symlinks planted by the
+	// owner of the file.
+	dir, err := OpenSecureDirectory(
+		filepath.Dir(file.Path), int(stat.Uid), int(stat.Gid), 0700,
+	)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return transaction.StageCopy(
+		dir, filepath.Base(file.Path), file.Kind, source,
+	)
+}
+
+// installFileCopy atomically replaces file at specified path with contents
+// and attributes of the source file. Path is resolved without following
+// symlinks planted by the owner of the source file.
+func installFileCopy(source *os.File, path string) error {
+	var stat unix.Stat_t
+
+	err := unix.Fstat(int(source.Fd()), &stat)
+	if err != nil {
+		return hierr.Errorf(err, "can't stat %s", source.Name())
+	}
+
+	dir, err := OpenSecureDirectory(
+		filepath.Dir(path), int(stat.Uid), int(stat.Gid), 0700,
+	)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	name := filepath.Base(path)
+
+	temporaryFile, err := dir.CreateTempFile(name, 0600)
+	if err != nil {
+		return err
+	}
+	defer temporaryFile.Close()
+
+	temporaryName := filepath.Base(temporaryFile.Name())
+
+	_, err = io.Copy(temporaryFile, source)
+	if err == nil {
+		err = copyFileAttributes(source, temporaryFile)
+	}
+	if err == nil {
+		err = temporaryFile.Sync()
+	}
+	if err == nil {
+		err = temporaryFile.Close()
+	}
+	if err != nil {
+		dir.Remove(temporaryName)
+
+		return hierr.Errorf(
+			err, "can't write temporary file %s", temporaryFile.Name(),
+		)
+	}
+
+	err = dir.Rename(temporaryName, name)
+	if err != nil {
+		dir.Remove(temporaryName)
+
+		return hierr.Errorf(
+			err, "can't rename %s to %s", temporaryFile.Name(), path,
+		)
+	}
+
+	return dir.Sync()
+}
+
+// AddSecureFile stores copy of the file with specified name located in the
+// directory, missing file is skipped.
+func (backup *Backup) AddSecureFile(
+	dir *SecureDirectory, name string, kind string,
+) error {
+	file, err := dir.OpenFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+	defer file.Close()
+
+	return backup.Add(filepath.Join(dir.GetPath(), name), kind, file)
+}
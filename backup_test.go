@@ -0,0 +1,276 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testContents string
+
+func (contents testContents) Write(writer io.Writer) (int, error) {
+	return io.WriteString(writer, string(contents))
+}
+
+func stageTestFile(
+	t *testing.T, transaction *Transaction, path string, kind string,
+	contents string,
+) {
+	dir, err := OpenSecureDirectory(filepath.Dir(path), 0, 0, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	err = transaction.Stage(
+		dir, filepath.Base(path), kind, 0600,
+		testContents(contents), nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(contents)
+}
+
+func writeTestFile(t *testing.T, path string, contents string) {
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupIsMadeOnlyOnChange(t *testing.T) {
+	root := t.TempDir()
+	stateDir := filepath.Join(root, "state")
+
+	shadowPath := filepath.Join(root, "shadow")
+	statePath := filepath.Join(root, "state.json")
+
+	writeTestFile(t, shadowPath, "root:!:1::::::\n")
+	writeTestFile(t, statePath, "{}\n")
+
+	store := NewBackupStore(stateDir, 10)
+
+	run := func(shadow string) {
+		transaction, err := NewTransaction(
+			stateDir, time.Second, store.Create(),
+			BackupKindShadow, BackupKindState,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stageTestFile(t, transaction, shadowPath, BackupKindShadow, shadow)
+		stageTestFile(
+			t, transaction, statePath, BackupKindState,
+			time.Now().String(),
+		)
+
+		err = transaction.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("root:!:1::::::\n")
+
+	backups, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 0 {
+		t.Fatalf("unchanged files should not be backed up: %d", len(backups))
+	}
+
+	run("root:!:2::::::\n")
+
+	backups, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 1 || len(backups[0].Files) != 2 {
+		t.Fatalf("changed shadow and state should be backed up: %v", backups)
+	}
+}
+
+func TestShadowPreviousVersionIsSavedOnCommit(t *testing.T) {
+	root := t.TempDir()
+	stateDir := filepath.Join(root, "state")
+
+	shadowPath := filepath.Join(root, "shadow")
+
+	writeTestFile(t, shadowPath, "root:!:1::::::\n")
+
+	transaction, err := NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stageTestFile(
+		t, transaction, shadowPath, BackupKindShadow, "root:!:2::::::\n",
+	)
+
+	transaction.Abort()
+
+	_, err = os.Stat(shadowPath + "-")
+	if !os.IsNotExist(err) {
+		t.Fatal("previous version should not be saved by aborted transaction")
+	}
+
+	transaction, err = NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stageTestFile(
+		t, transaction, shadowPath, BackupKindShadow, "root:!:2::::::\n",
+	)
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readTestFile(t, shadowPath+"-") != "root:!:1::::::\n" {
+		t.Fatal("previous version should be saved on commit")
+	}
+
+	if readTestFile(t, shadowPath) != "root:!:2::::::\n" {
+		t.Fatal("new version should be installed")
+	}
+}
+
+func TestBackupRotateAndRestore(t *testing.T) {
+	root := t.TempDir()
+
+	path := filepath.Join(root, "authorized_keys")
+
+	store := NewBackupStore(filepath.Join(root, "state"), 2)
+
+	for _, contents := range []string{"first\n", "second\n", "third\n"} {
+		writeTestFile(t, path, contents)
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.Create().Add(path, BackupKindAuthorizedKeys, file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := store.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups after rotation, got %d", len(backups))
+	}
+
+	oldest, err := store.Get(backups[0].Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction, err := NewTransaction(
+		filepath.Join(root, "state"), time.Second, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = oldest.Restore(transaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readTestFile(t, path) != "third\n" {
+		t.Fatal("file should be replaced only on commit")
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readTestFile(t, path) != "second\n" {
+		t.Fatalf("unexpected restored contents %q", readTestFile(t, path))
+	}
+}
+
+func TestBackupRestoreIsAtomic(t *testing.T) {
+	root := t.TempDir()
+	stateDir := filepath.Join(root, "state")
+
+	first := filepath.Join(root, "first")
+	second := filepath.Join(root, "second")
+
+	writeTestFile(t, first, "old first\n")
+	writeTestFile(t, second, "old second\n")
+
+	backup := NewBackupStore(stateDir, 10).Create()
+
+	for _, path := range []string{first, second} {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = backup.Add(path, BackupKindAuthorizedKeys, file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeTestFile(t, first, "new first\n")
+	writeTestFile(t, second, "new second\n")
+
+	// copy of the second file can't be read, so nothing is restored.
+	err := os.Remove(filepath.Join(backup.dir, backup.Files[1].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction, err := NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backup.Restore(transaction)
+	if err == nil {
+		t.Fatal("restore should fail")
+	}
+
+	transaction.Abort()
+
+	if readTestFile(t, first) != "new first\n" {
+		t.Fatal("first file should not be restored alone")
+	}
+
+	if len(getTemporaryFiles(t, root)) != 0 {
+		t.Fatal("temporary files should be removed")
+	}
+}
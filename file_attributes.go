@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reconquest/hierr-go"
+
+	"golang.org/x/sys/unix"
+)
+
+const securityXattrPrefix = "security."
+
+// copyFileAttributes copies mode, owner and security extended attributes,
+// like SELinux context, of the source file to the target file, so target can
+// replace source without changing who can read it.
+func copyFileAttributes(source *os.File, target *os.File) error {
+	var stat unix.Stat_t
+
+	err := unix.Fstat(int(source.Fd()), &stat)
+	if err != nil {
+		return hierr.Errorf(err, "can't stat %s", source.Name())
+	}
+
+	fd := int(target.Fd())
+
+	err = unix.Fchown(fd, int(stat.Uid), int(stat.Gid))
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't change owner of %s", target.Name(),
+		)
+	}
+
+	// fchmod is called after fchown, because changing owner can reset
+	// setuid and setgid bits.
+	err = unix.Fchmod(fd, stat.Mode&07777)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't change mode of %s", target.Name(),
+		)
+	}
+
+	names, err := listXattrs(source)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't list extended attributes of %s", source.Name(),
+		)
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, securityXattrPrefix) {
+			continue
+		}
+
+		value, err := getXattr(source, name)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't read extended attribute %s of %s",
+				name, source.Name(),
+			)
+		}
+
+		err = unix.Fsetxattr(fd, name, value, 0)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't set extended attribute %s of %s",
+				name, target.Name(),
+			)
+		}
+	}
+
+	return nil
+}
+
+// listXattrs returns names of extended attributes of the file, file system
+// which does not support extended attributes has none.
+func listXattrs(file *os.File) ([]string, error) {
+	size, err := unix.Flistxattr(int(file.Fd()), nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	buffer := make([]byte, size)
+
+	size, err = unix.Flistxattr(int(file.Fd()), buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(string(buffer[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+func getXattr(file *os.File, name string) ([]byte, error) {
+	size, err := unix.Fgetxattr(int(file.Fd()), name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, size)
+
+	size, err = unix.Fgetxattr(int(file.Fd()), name, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer[:size], nil
+}
+
+// syncDirectory flushes entries of the directory containing specified
+// file, so rename of the file survives crash.
+func syncDirectory(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
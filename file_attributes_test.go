@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func checkTestFileAttributes(
+	t *testing.T, path string, mode os.FileMode, uid int, gid int,
+) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Mode()&(os.ModePerm|os.ModeSetgid) != mode {
+		t.Errorf("%s: expected mode %s, got %s", path, mode, stat.Mode())
+	}
+
+	owner := stat.Sys().(*syscall.Stat_t)
+	if int(owner.Uid) != uid || int(owner.Gid) != gid {
+		t.Errorf(
+			"%s: expected owner %d:%d, got %d:%d",
+			path, uid, gid, owner.Uid, owner.Gid,
+		)
+	}
+}
+
+func TestCopyFileAttributes(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing file owner requires root")
+	}
+
+	root := t.TempDir()
+
+	sourcePath := filepath.Join(root, "source")
+	targetPath := filepath.Join(root, "target")
+
+	writeTestFile(t, sourcePath, "source")
+	writeTestFile(t, targetPath, "target")
+
+	err := os.Chown(sourcePath, 65534, 65534)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// setgid bit is set after chown, because chown resets it.
+	err = os.Chmod(sourcePath, 0640|os.ModeSetgid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(targetPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	err = copyFileAttributes(source, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestFileAttributes(t, targetPath, 0640|os.ModeSetgid, 65534, 65534)
+
+	if readTestFile(t, targetPath) != "target" {
+		t.Fatal("contents of target file should not be changed")
+	}
+}
+
+func TestTransactionStageKeepsShadowAttributes(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing file owner requires root")
+	}
+
+	root := t.TempDir()
+
+	shadowPath := filepath.Join(root, "shadow")
+	writeTestFile(t, shadowPath, "root:!:1::::::\n")
+
+	// shadow file is usually readable by group 'shadow'.
+	err := os.Chown(shadowPath, 0, 65534)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chmod(shadowPath, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction, err := NewTransaction(
+		filepath.Join(root, "state"), time.Second, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stageTestFile(
+		t, transaction, shadowPath, BackupKindShadow, "root:!:2::::::\n",
+	)
+
+	checkTestFileAttributes(
+		t, filepath.Join(root, transaction.files[0].Temporary),
+		0640, 0, 65534,
+	)
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestFileAttributes(t, shadowPath, 0640, 0, 65534)
+
+	if readTestFile(t, shadowPath) != "root:!:2::::::\n" {
+		t.Fatal("shadow file should be replaced")
+	}
+}
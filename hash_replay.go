@@ -0,0 +1,83 @@
+package main
+
+const (
+	ReplayActionWarn   = "warn"
+	ReplayActionRefuse = "refuse"
+	ReplayActionFail   = "fail"
+
+	// hashHistorySize is amount of the latest received hashes which are
+	// remembered for every user. shadowd picks hash from the table of user
+	// hashes randomly, so with table of N hashes legitimate hash is flagged
+	// as replayed with probability of about hashHistorySize/N on every run,
+	// e.g. 3% for the table of 2048 hashes, and on every run if the table
+	// is not larger than history.
+	hashHistorySize = 64
+)
+
+func isValidReplayAction(action string) bool {
+	switch action {
+	case ReplayActionWarn, ReplayActionRefuse, ReplayActionFail:
+		return true
+	}
+
+	return false
+}
+
+// checkReplayedHashes detects hashes which have been already received,
+// either twice within one request or during previous runs, and handles them
+// according to specified action. All received hashes are remembered in the
+// state. Hashes which should be installed are returned along with names of
+// users which hashes are not installed because of 'fail' action, so caller
+// can report them after updating other users.
+func checkReplayedHashes(
+	shadows *Shadows, state *State, pool string, action string,
+) (*Shadows, []string) {
+	allowed := Shadows{}
+	replayedUsers := []string{}
+
+	for _, shadow := range *shadows {
+		reason := ""
+		switch {
+		case shadow.IsRepeated:
+			reason = "was recently requested"
+
+		case state.IsHashSeen(shadow.Username, shadow.Hash):
+			reason = "has been already received before"
+		}
+
+		state.GetUser(shadow.Username, pool).RememberHash(shadow.Hash)
+
+		if reason == "" {
+			allowed = append(allowed, shadow)
+			continue
+		}
+
+		switch action {
+		case ReplayActionWarn:
+			warningf(
+				"[!] hash for %s %s; possible break-in attempt.",
+				user{shadow.Username, pool}, reason,
+			)
+
+			allowed = append(allowed, shadow)
+
+		case ReplayActionRefuse:
+			errorf(
+				"[!] hash for %s %s; possible break-in attempt, "+
+					"hash is not installed.",
+				user{shadow.Username, pool}, reason,
+			)
+
+		default:
+			errorf(
+				"[!] hash for %s %s; possible break-in attempt, "+
+					"hash is not installed.",
+				user{shadow.Username, pool}, reason,
+			)
+
+			replayedUsers = append(replayedUsers, shadow.Username)
+		}
+	}
+
+	return &allowed, replayedUsers
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUserStateRememberHash(t *testing.T) {
+	state, err := LoadState(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.IsHashSeen("john", "$6$first") {
+		t.Fatal("hash of unknown user should not be seen")
+	}
+
+	userState := state.GetUser("john", "")
+
+	userState.RememberHash("$6$first")
+	userState.RememberHash("$6$first")
+
+	if len(userState.HashHistory) != 1 {
+		t.Fatalf("hash should be remembered once: %q", userState.HashHistory)
+	}
+
+	if !state.IsHashSeen("john", "$6$first") {
+		t.Fatal("remembered hash should be seen")
+	}
+
+	if state.IsHashSeen("bob", "$6$first") {
+		t.Fatal("history should be kept per user")
+	}
+
+	for i := 0; i < hashHistorySize; i++ {
+		userState.RememberHash(fmt.Sprintf("$6$%d", i))
+	}
+
+	if len(userState.HashHistory) != hashHistorySize {
+		t.Fatalf(
+			"history should be limited to %d hashes, got %d",
+			hashHistorySize, len(userState.HashHistory),
+		)
+	}
+
+	if state.IsHashSeen("john", "$6$first") {
+		t.Fatal("oldest hash should be rotated out")
+	}
+
+	if !state.IsHashSeen("john", fmt.Sprintf("$6$%d", hashHistorySize-1)) {
+		t.Fatal("latest hash should be kept")
+	}
+}
+
+func TestCheckReplayedHashes(t *testing.T) {
+	testcases := []struct {
+		action   string
+		allowed  int
+		replayed int
+	}{
+		{ReplayActionWarn, 3, 0},
+		{ReplayActionRefuse, 1, 0},
+		{ReplayActionFail, 1, 2},
+	}
+
+	for _, testcase := range testcases {
+		state, err := LoadState(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		state.GetUser("seen", "").RememberHash("$6$seen")
+
+		shadows := &Shadows{
+			{Username: "fresh", Hash: "$6$fresh"},
+			{Username: "seen", Hash: "$6$seen"},
+			{Username: "repeated", Hash: "$6$repeated", IsRepeated: true},
+		}
+
+		allowed, replayed := checkReplayedHashes(
+			shadows, state, "", testcase.action,
+		)
+
+		if len(*allowed) != testcase.allowed {
+			t.Errorf(
+				"%s: expected %d allowed hashes, got %d",
+				testcase.action, testcase.allowed, len(*allowed),
+			)
+		}
+
+		if len(replayed) != testcase.replayed {
+			t.Errorf(
+				"%s: expected %d replayed users, got %q",
+				testcase.action, testcase.replayed, replayed,
+			)
+		}
+
+		if (*allowed)[0].Username != "fresh" {
+			t.Errorf("%s: fresh hash should be allowed", testcase.action)
+		}
+
+		if !state.IsHashSeen("fresh", "$6$fresh") {
+			t.Errorf("%s: received hash should be remembered", testcase.action)
+		}
+	}
+}
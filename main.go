@@ -3,19 +3,21 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
-	"path"
+	osuser "os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/reconquest/executil-go"
-	"github.com/reconquest/srv-go"
 	"github.com/kovetskiy/godocs"
 	"github.com/kovetskiy/lorg"
 	"github.com/reconquest/colorgful"
+	"github.com/reconquest/executil-go"
 	"github.com/reconquest/hierr-go"
+	"github.com/reconquest/srv-go"
 )
 
 var version = "3.0"
@@ -27,6 +29,9 @@ shadow file (/etc/shadow) accordingly.
 It is capable of requesting users list from shadowd server and creating them,
 as well as updating theirs SSH keys (authorized_keys).
 
+shadowc can also be used as AuthorizedKeysCommand of sshd:
+  AuthorizedKeysCommand /usr/bin/shadowc authorized-keys -p <pool> %u
+
 Most common invocation is:
   shadowc -KtC -p <pool> --all
 
@@ -38,16 +43,60 @@ Most common invocation is:
   Requests will be sent to addresses which resolves from SRV record _shadowd.
 
 Usage:
-  shadowc [options] [-K [-t]] [-C [-g <args>]] [-p <pool>] [-s <addr>...] -u <user>...
-  shadowc [options] [-K [-t]] [-C [-g <args>]]  -p <pool>  [-s <addr>...] --all
-  shadowc [options] [-K [-t]] [-p <pool>] -s <addr>... --update
-  shadowc [options] -P [-s <addr>...] [-p <pool>] -u <user>
+  shadowc [options] [-K [-t | -m]] [-C [-g <args>]] [-p <pool>] [-s <addr>...] -u <user>...
+  shadowc [options] [-K [-t | -m]] [-C [-g <args>]]  -p <pool>  [-s <addr>...] --all
+  shadowc [options] [-K [-t | -m]] [-p <pool>] -s <addr>... --update
+  shadowc [options] -P [-G] [-Q | --all-servers [--quorum <n>]] [-s <addr>...] [-p <pool>] -u <user>
+  shadowc [options] passwd --status
+  shadowc [options] rollback [--to <timestamp> | --list]
+  shadowc [options] status
+  shadowc [options] check [--remote] [-s <addr>...] [-p <pool>] -u <user>
+  shadowc [options] authorized-keys [-s <addr>...] [-p <pool>] <user>
   shadowc -v | --version
   shadowc -h | --help
 
 Options:
   -P --password         Generate new hash table for specified user. Will prompt
                          for old and new passwords.
+  -G --generate         Generate random password instead of prompting for new
+                         one. Generated password will be printed once to stdout
+                         or to file descriptor specified by '--password-fd'.
+  --password-style <style>
+                        Style of generated password: 'random' for random
+                         characters or 'passphrase' for pronounceable words
+                         separated by dashes. [default: random]
+  --password-length <n>
+                        Length of generated password: amount of characters for
+                         'random' style (24 by default) or amount of words for
+                         'passphrase' style (6 by default).
+  --password-fd <fd>    Write generated password to specified file descriptor
+                         instead of stdout.
+  --all-servers         Change password on all alive shadowd servers instead of
+                         first one which accepts change. Salts retrieved from
+                         servers will be checked for consistency.
+  --quorum <n>          Minimum amount of shadowd servers which should accept
+                         password change, used together with '--all-servers'.
+                         By default, all alive servers should accept change.
+  -Q --queue           Queue password change locally if all shadowd servers are
+                         unreachable. Queued change is encrypted using queue
+                         key and will be submitted after the next run
+                         of shadowc in pull mode. Queue key is stored on the
+                         host, so root or anyone having backup of the key
+                         and the queue can decrypt old and new passwords.
+  --queue-key <path>    Set path of the key file, which is used for
+                         encrypting queued password changes, key is generated
+                         if file does not exist [default: /etc/shadowc/queue.key].
+  --status              Show status of queued password changes.
+  --remote              Also check that shadow entry was generated from the
+                         current hash table on shadowd servers, used together
+                         with 'check' command.
+  --cache-dir <dir>     Set directory for caching SSH keys printed by
+                         'authorized-keys' command [default: /var/cache/shadowc].
+  --cache-ttl <ttl>     Use cached SSH keys instead of requesting shadowd servers
+                         if cache is younger than specified duration. Stale cache
+                         is used if shadowd servers are unreachable [default: 5m].
+  --timeout <timeout>   Time limit for retrieving SSH keys by 'authorized-keys'
+                         command [default: 5s].
   -C --create           Create user if it does not exists. User will be created with
                          command 'useradd'. Additional parameters for 'useradd' can be
                          passed using option '-g'.
@@ -58,6 +107,44 @@ Options:
   -K --keys             Request SSH keys from shadowd server and append them to the
                          user's authorized_keys file.
   -t --overwrite-keys   Overwrite authorized_keys file instead of appending.
+  -m --managed-keys     Overwrite only block of authorized_keys file, which is
+                         delimited by shadowc marker comments, and preserve all
+                         keys outside of that block.
+  --deny-key-types <types>
+                        Do not install SSH keys of specified types. Types are
+                         comma-separated, either full type names or short ones:
+                         'dsa', 'rsa', 'ecdsa', 'ed25519'.
+  --min-rsa-bits <bits> Do not install RSA keys which size is less than
+                         specified amount of bits.
+  --require-key-options <options>
+                        Do not install SSH keys which do not have all specified
+                         comma-separated options, e.g. 'from,no-pty'.
+  --sk-keys-only        Install only FIDO SSH keys (sk-*).
+  --key-options <path>  Set path to file with options which will be prepended
+                         to SSH keys of specified pools and users, in format
+                         '<pool>/<user> <options>' per line
+                         [default: /etc/shadowc/key-options].
+  --keys-path <path>    Set path template of authorized_keys file, '%u' is
+                         replaced with user name and '%h' with user home
+                         directory. Files outside of home directories are owned
+                         by root [default: %h/.ssh/authorized_keys].
+  -R --principals       Request SSH certificate principals of users and
+                         trusted user CA keys from shadowd server and write
+                         them into files used by sshd AuthorizedPrincipalsFile
+                         and TrustedUserCAKeys.
+  --principals-path <path>
+                        Set path template of principals file, '%u' is replaced
+                         with user name and '%h' with user home directory
+                         [default: /etc/ssh/auth_principals/%u].
+  --ca-keys-path <path> Set path of trusted user CA keys file
+                         [default: /etc/ssh/trusted_user_ca_keys].
+  --revoked-keys <path> Request list of revoked SSH keys from shadowd server,
+                         write it into specified file, which can be used as
+                         sshd RevokedKeys. Together with '-K' revoked keys
+                         are also removed from authorized_keys files.
+  --repair-permissions  Remove group and others write permissions from
+                         authorized_keys file and directories containing it,
+                         which make sshd ignore keys when StrictModes is on.
   -s --server <addr>    Use specified login distribution server address.
                          There are several servers can be specified, then shadowc will
                          try to request information from the next server is previous
@@ -73,6 +160,31 @@ Options:
                          which already has passwords.
   -c --cert <path>      Set certificate file path [default: /etc/shadowc/cert.pem].
   -f --shadow <file>    Set shadow file path [default: /etc/shadow].
+  --lock-timeout <timeout>
+                        Time limit for acquiring lock of shadow file, which is
+                         also used by passwd, useradd and other shadow-utils
+                         [default: 15s].
+  --run-lock <path>     Set path of the lock file, which prevents several
+                         instances of shadowc from updating files at the same
+                         time [default: /run/shadowc/shadowc.lock].
+  --run-lock-wait <timeout>
+                        Wait for specified time if another instance of shadowc
+                         is running, then exit with code 3 [default: 0s].
+  --backups <n>         Amount of backups of shadow file, which are kept in state
+                         directory, '0' disables backups. Previous version of
+                         shadow file is also saved as '<shadow>-' [default: 10].
+  --backup-keys         Also backup authorized_keys files before changing them.
+  --on-replay <action>  Action for hash which has been already received
+                         before: 'warn' installs it anyway, 'refuse' keeps
+                         current hash of the user, 'fail' keeps current hash
+                         of the user and exits with error after updating
+                         other users [default: warn].
+  --to <timestamp>      Restore backup made at specified time, used together
+                         with 'rollback' command. Latest backup is restored by
+                         default.
+  --list                List backups, used together with 'rollback' command.
+  -d --state-dir <dir>  Set directory for storing shadowc state
+                         [default: /var/lib/shadowc].
   -w --passwd <passwd>  Set passwd file path (for reading user home dir locations).
                          [default: /etc/passwd]
   --no-srv              Do not try to find shadowd addresses prefixed by '_' in SRV
@@ -122,14 +234,58 @@ func main() {
 		)
 	}
 
-	addresses := args["--server"].([]string)
-	if !args["--no-srv"].(bool) {
-		addresses = tryToResolveSRV(addresses)
+	switch {
+	case args["passwd"].(bool):
+		err = handlePasswordChangeQueueStatus(args)
+		if err != nil {
+			fatalln(err)
+		}
+
+		return
+
+	case args["status"].(bool):
+		err = handleStatus(args)
+		if err != nil {
+			fatalln(err)
+		}
+
+		return
+
+	case args["check"].(bool):
+		// local check does not need shadowd servers, so client is created
+		// only for --remote.
+		err = handleCheckPassword(args)
+		if err != nil {
+			fatalln(err)
+		}
+
+		return
+
+	case args["authorized-keys"].(bool):
+		// client is created only if cached keys are stale, so logins don't
+		// wait for resolving SRV records.
+		err = handleAuthorizedKeysCommand(args)
+		if err != nil {
+			fatalln(err)
+		}
+
+		return
+
+	case args["rollback"].(bool):
+		lock := acquireRunLock(args)
+
+		err = handleRollback(args)
+		lock.Release()
+		if err != nil {
+			fatalln(err)
+		}
+
+		return
 	}
 
-	upstream, err := NewShadowdUpstream(addresses, args["--cert"].(string))
+	upstream, err := newShadowdUpstream(args)
 	if err != nil {
-		fatalh(err, "can't initialize shadowd client")
+		fatalln(err)
 	}
 
 	switch {
@@ -137,7 +293,10 @@ func main() {
 		err = handleChangePassword(upstream, args)
 
 	default:
+		lock := acquireRunLock(args)
+
 		err = handlePull(upstream, args)
+		lock.Release()
 	}
 
 	if err != nil {
@@ -145,280 +304,1130 @@ func main() {
 	}
 }
 
-func handleChangePassword(
-	upstream *ShadowdUpstream, args map[string]interface{},
-) error {
-	var (
-		username = args["--user"].([]string)[0]
-		pool, _  = args["--pool"].(string)
-	)
-
-	if username == "" {
-		return errors.New("username can't be empty")
-	}
-
-	oldpassword, err := getPassword("Password: ")
-	if err != nil {
-		return hierr.Errorf(
-			err, "can't prompt for password",
-		)
-	}
-
-	password, err := getPassword("New password: ")
-	if err != nil {
-		return hierr.Errorf(
-			err, "can't prompt for new password",
-		)
+// newShadowdUpstream creates client of shadowd servers specified via
+// --server or resolved from SRV records.
+func newShadowdUpstream(
+	args map[string]interface{},
+) (*ShadowdUpstream, error) {
+	addresses := args["--server"].([]string)
+	if !args["--no-srv"].(bool) {
+		addresses = tryToResolveSRV(addresses)
 	}
 
-	proofPassword, err := getPassword("Repeat new password: ")
+	upstream, err := NewShadowdUpstream(addresses, args["--cert"].(string))
 	if err != nil {
-		return hierr.Errorf(
-			err, "can't prompt for repeat new password",
-		)
-	}
-
-	if proofPassword != password {
-		return errors.New("specified passwords do not match")
-	}
-
-	if password == "" {
-		return errors.New("password can't be empty")
+		return nil, hierr.Errorf(err, "can't initialize shadowd client")
 	}
 
-	infof("retrieving shadow salts")
-
-	salts, err := getPasswordChangeSalts(upstream, pool, username)
-	if err != nil {
-		return hierr.Errorf(
-			err, "can't retrieve salts for changing password",
-		)
-	}
+	return upstream, nil
+}
 
-	infof(
-		"generating proof shadows using " +
-			"specified password and retrieved salts",
+// acquireRunLock prevents concurrent runs of shadowc, which change the same
+// files. If lock is held by another instance, shadowc exits with distinct
+// exit code.
+func acquireRunLock(args map[string]interface{}) *RunLock {
+	var (
+		path    = args["--run-lock"].(string)
+		rawWait = args["--run-lock-wait"].(string)
 	)
 
-	shadows := []string{}
-	for _, salt := range salts {
-		shadows = append(shadows, crypt(oldpassword, salt))
+	wait, err := time.ParseDuration(rawWait)
+	if err != nil {
+		fatalh(err, "invalid run lock wait time %q", rawWait)
 	}
 
-	infof("requesting hash table generating with new password")
-
-	err = changePassword(upstream, pool, username, shadows, password)
+	lock, err := AcquireRunLock(path, wait)
 	if err != nil {
-		return err
-	}
+		if _, ok := err.(RunLockedError); ok {
+			errorln(err)
+			os.Exit(exitCodeRunLocked)
+		}
 
-	infof("hash table for %s successfully generated", user{username, pool})
+		fatalh(err, "can't acquire run lock")
+	}
 
-	return nil
+	return lock
 }
 
-func handlePull(
+func handleChangePassword(
 	upstream *ShadowdUpstream, args map[string]interface{},
 ) error {
 	var (
-		shadowFilepath         = args["--shadow"].(string)
-		useUsersFromShadowFile = args["--update"].(bool)
-		useUsersFromRemotePool = args["--all"].(bool)
-		shouldCreateUser       = args["--create"].(bool)
-		shouldUpdateSSHKeys    = args["--keys"].(bool)
-		useraddArgs            = args["--useradd"].(string)
-		passwdFilePath         = args["--passwd"].(string)
-		pool, _                = args["--pool"].(string)
-
-		shouldOverwriteAuthorizedKeys = args["--overwrite-keys"].(bool)
+		username          = args["--user"].([]string)[0]
+		pool, _           = args["--pool"].(string)
+		shouldGenerate    = args["--generate"].(bool)
+		passwordStyle     = args["--password-style"].(string)
+		passwordLength, _ = args["--password-length"].(string)
+		passwordFD, _     = args["--password-fd"].(string)
+		passwordOutput    = os.Stdout
+		useAllServers     = args["--all-servers"].(bool)
+		rawQuorum, _      = args["--quorum"].(string)
+		quorum            = 0
+		shouldQueue       = args["--queue"].(bool)
+		queueKeyPath      = args["--queue-key"].(string)
+		stateDir          = args["--state-dir"].(string)
 	)
 
-	var usernames []string
-	switch {
-	case useUsersFromShadowFile:
-		infof(
-			"retrieving users with passwords from shadow file %s",
-			shadowFilepath,
-		)
+	if username == "" {
+		return errors.New("username can't be empty")
+	}
 
+	if rawQuorum != "" {
 		var err error
-		usernames, err = getUsersWithPasswords(shadowFilepath)
+		quorum, err = strconv.Atoi(rawQuorum)
+		if err != nil || quorum < 1 {
+			return fmt.Errorf("invalid quorum %q", rawQuorum)
+		}
+	}
+
+	var queueKey []byte
+	if shouldQueue {
+		var err error
+		queueKey, err = ReadQueueKey(queueKeyPath, true)
 		if err != nil {
 			return hierr.Errorf(
-				err, "can't extract users from shadow file %s", shadowFilepath,
+				err, "can't read key for queueing password changes",
 			)
 		}
+	}
 
-	case useUsersFromRemotePool:
-		infof(
-			"retrieving users from remote pool %s",
-			pool,
-		)
-
+	var generator *passwordGenerator
+	if shouldGenerate {
 		var err error
-		usernames, err = getAllUsersFromPool(pool, upstream)
+		generator, err = newPasswordGenerator(passwordStyle, passwordLength)
 		if err != nil {
-			return hierr.Errorf(
-				err, "can't retrieve users within pool %s", pool,
-			)
+			return err
 		}
 
-	default:
-		usernames = args["--user"].([]string)
-		for _, username := range usernames {
-			if username == "" {
-				return errors.New("username can't be empty")
+		if passwordFD != "" {
+			passwordOutput, err = openPasswordOutput(passwordFD)
+			if err != nil {
+				return hierr.Errorf(
+					err, "can't use file descriptor %s for password output",
+					passwordFD,
+				)
 			}
 		}
 	}
 
-	infof(
-		"retrieving shadow entries for %s",
-		users{usernames, pool},
-	)
-
-	shadows, err := getShadows(
-		usernames, upstream, pool, useUsersFromShadowFile,
-	)
-	if err != nil {
-		return hierr.Errorf(err, "can't retrieve shadow entries")
-	}
-
-	infof(
-		"retrieving ssh keys for %s",
-		users{usernames, pool},
-	)
-
-	authorizedKeys, err := getAuthorizedKeys(
-		usernames, upstream, pool,
-	)
+	oldpassword, err := getPassword("Password: ")
 	if err != nil {
 		return hierr.Errorf(
-			err, "can't retrieve authorized keys for %s",
-			users{usernames, pool},
+			err, "can't prompt for password",
 		)
 	}
 
-	if shouldCreateUser {
-		infof("reading shadow file %s", shadowFilepath)
-
-		shadowFile, err := ReadShadowFile(shadowFilepath)
+	var password string
+	if shouldGenerate {
+		password, err = generator.Generate()
 		if err != nil {
 			return hierr.Errorf(
-				err, "can't read shadow file %s", shadowFilepath,
+				err, "can't generate new password",
 			)
 		}
 
-		for _, shadow := range *shadows {
-			_, err := shadowFile.GetUserIndex(shadow.Username)
-			if err != nil {
-				infof("creating user %s", shadow.Username)
-
-				err := createUser(shadow.Username, useraddArgs)
-				if err != nil {
-					return hierr.Errorf(
-						err, "can't create user %s", shadow.Username,
-					)
-				}
-			}
-		}
-	}
-
-	if len(*shadows) > 0 {
-		infof("reading shadow file %s", shadowFilepath)
-
-		shadowFile, err := ReadShadowFile(shadowFilepath)
+		infof(
+			"generated %s password with ~%.0f bits of entropy",
+			passwordStyle, generator.Entropy(),
+		)
+	} else {
+		password, err = getPassword("New password: ")
 		if err != nil {
 			return hierr.Errorf(
-				err, "can't read shadow file %s", shadowFilepath,
+				err, "can't prompt for new password",
 			)
 		}
 
-		infof("updating %d shadow entries", len(*shadows))
-
-		err = writeShadows(shadows, shadowFile)
+		proofPassword, err := getPassword("Repeat new password: ")
 		if err != nil {
 			return hierr.Errorf(
-				err, "can't write shadow entries to %s", shadowFilepath,
+				err, "can't prompt for repeat new password",
 			)
 		}
 
-		infof("shadow entries updated", len(*shadows))
+		if proofPassword != password {
+			return errors.New("specified passwords do not match")
+		}
 	}
 
-	if shouldUpdateSSHKeys {
-		infof("updating %d ssh keys", len(authorizedKeys))
+	if password == "" {
+		return errors.New("password can't be empty")
+	}
 
-		written, err := writeSSHKeys(
-			usernames, authorizedKeys, passwdFilePath,
-			shouldOverwriteAuthorizedKeys,
+	if useAllServers {
+		var changed int
+		changed, err = changePasswordOnAllServers(
+			upstream, pool, username, oldpassword, password, quorum,
 		)
 		if err != nil {
+			// generated password is already accepted by some servers, so
+			// it should be known even if quorum is not reached.
+			if shouldGenerate && changed > 0 {
+				_, outputErr := fmt.Fprintln(passwordOutput, password)
+				if outputErr != nil {
+					errorh(outputErr, "can't output generated password")
+				}
+			}
+
+			return err
+		}
+	} else {
+		infof("retrieving shadow salts")
+
+		salts, err := getPasswordChangeSalts(upstream, pool, username)
+		if err != nil {
+			if shouldQueue && !upstream.HasAliveShadowdHosts() {
+				return queuePasswordChangeForLater(
+					NewPasswordChangeQueue(stateDir), queueKey,
+					pool, username, oldpassword, password,
+					shouldGenerate, passwordOutput,
+				)
+			}
+
 			return hierr.Errorf(
-				err, "can't update ssh keys",
+				err, "can't retrieve salts for changing password",
 			)
 		}
 
 		infof(
-			"ssh keys updated: %d new, %d already installed",
-			written, len(authorizedKeys)-written,
+			"generating proof shadows using " +
+				"specified password and retrieved salts",
 		)
-	}
 
-	return nil
-}
+		shadows := getProofShadows(oldpassword, salts)
 
-func getPasswordChangeSalts(
-	upstream *ShadowdUpstream, pool, username string,
-) ([]string, error) {
-	shadowdHosts, err := upstream.GetAliveShadowdHosts()
-	if err != nil {
-		return nil, err
-	}
+		infof("requesting hash table generating with new password")
 
-	for _, shadowdHost := range shadowdHosts {
-		salts, err := shadowdHost.GetPasswordChangeSalts(pool, username)
+		err = changePassword(upstream, pool, username, shadows, password)
 		if err != nil {
-			switch err.(type) {
-			case NotFoundError:
-				warningf(
-					"[%s] is not aware of %s",
-					shadowdHost.GetAddr(), user{username, pool},
-				)
-
-			default:
-				shadowdHost.SetIsAlive(false)
+			return err
+		}
+	}
 
-				errorh(
-					err,
-					"[%s] has gone away", shadowdHost.GetAddr(),
-				)
-			}
+	infof("hash table for %s successfully generated", user{username, pool})
 
-			continue
+	if shouldGenerate {
+		_, err = fmt.Fprintln(passwordOutput, password)
+		if err != nil {
+			return hierr.Errorf(
+				err, "password has been changed, but can't output "+
+					"generated password",
+			)
 		}
-
-		return salts, nil
 	}
 
-	return nil, fmt.Errorf(
-		"no information available for %s in all shadowd servers",
-		user{username, pool},
-	)
+	return nil
 }
 
-func changePassword(
-	upstream *ShadowdUpstream,
-	pool, username string, shadows []string, password string,
+func queuePasswordChangeForLater(
+	queue *PasswordChangeQueue, queueKey []byte,
+	pool, username, oldpassword, password string,
+	shouldGenerate bool, passwordOutput *os.File,
 ) error {
-	shadowdHosts, err := upstream.GetAliveShadowdHosts()
+	warningf(
+		"all shadowd servers are unreachable, "+
+			"queueing password change for %s",
+		user{username, pool},
+	)
+
+	err := queuePasswordChange(
+		queue, queueKey, pool, username, oldpassword, password,
+	)
 	if err != nil {
-		return err
+		return hierr.Errorf(
+			err, "can't queue password change for %s",
+			user{username, pool},
+		)
 	}
 
-	tracef("shadows: %q", shadows)
+	infof(
+		"password change for %s queued and will be submitted "+
+			"when shadowd servers become reachable",
+		user{username, pool},
+	)
 
-	for _, shadowdHost := range shadowdHosts {
+	if shouldGenerate {
+		_, err = fmt.Fprintln(passwordOutput, password)
+		if err != nil {
+			return hierr.Errorf(
+				err, "password change has been queued, but can't output "+
+					"generated password",
+			)
+		}
+	}
+
+	return nil
+}
+
+func handlePasswordChangeQueueStatus(args map[string]interface{}) error {
+	var (
+		stateDir = args["--state-dir"].(string)
+	)
+
+	changes, err := NewPasswordChangeQueue(stateDir).List()
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't list queued password changes",
+		)
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("no queued password changes")
+		return nil
+	}
+
+	for _, change := range changes {
+		status := "not submitted yet"
+		if change.Attempts > 0 {
+			status = fmt.Sprintf(
+				"%d failed attempts, last at %s: %s",
+				change.Attempts,
+				change.LastAttemptAt.Format(time.RFC3339),
+				change.LastError,
+			)
+		}
+
+		fmt.Printf(
+			"%s: queued at %s, %s\n",
+			user{change.Username, change.Pool},
+			change.CreatedAt.Format(time.RFC3339),
+			status,
+		)
+	}
+
+	return nil
+}
+
+// handleStatus shows what shadowc has installed on the host, hashes which
+// have been changed in shadow file since then are reported.
+func handleStatus(args map[string]interface{}) error {
+	var (
+		stateDir       = args["--state-dir"].(string)
+		shadowFilepath = args["--shadow"].(string)
+	)
+
+	state, err := LoadState(stateDir)
+	if err != nil {
+		return err
+	}
+
+	if state.UpdatedAt.IsZero() {
+		fmt.Println("shadowc has not updated this host yet")
+		return nil
+	}
+
+	fmt.Printf("last update at %s\n", state.UpdatedAt.Format(time.RFC3339))
+
+	shadowFile, err := ReadShadowFile(shadowFilepath)
+	if err != nil {
+		warningh(
+			err, "can't read shadow file %s, local changes of hashes "+
+				"are not reported", shadowFilepath,
+		)
+	}
+
+	for _, username := range state.GetUsernames() {
+		userState := state.Users[username]
+
+		statuses := []string{}
+
+		if userState.CreatedAt != nil {
+			statuses = append(
+				statuses,
+				"created at "+userState.CreatedAt.Format(time.RFC3339),
+			)
+		}
+
+		if userState.Hash != nil {
+			status := fmt.Sprintf(
+				"hash %s from %s installed at %s",
+				userState.Hash.Digest[:12], userState.Hash.Server,
+				userState.Hash.InstalledAt.Format(time.RFC3339),
+			)
+
+			if shadowFile != nil {
+				hash, err := shadowFile.GetHash(username)
+				switch {
+				case err != nil:
+					status += ", but user is missing in shadow file"
+
+				case getDigest([]byte(hash)) != userState.Hash.Digest:
+					status += ", but it has been changed since"
+				}
+			}
+
+			statuses = append(statuses, status)
+		}
+
+		if userState.Keys != nil {
+			statuses = append(statuses, fmt.Sprintf(
+				"%d ssh keys in %s from %s installed at %s",
+				len(userState.Keys.Fingerprints), userState.Keys.Path,
+				userState.Keys.Server,
+				userState.Keys.InstalledAt.Format(time.RFC3339),
+			))
+		}
+
+		fmt.Printf(
+			"%s: %s\n",
+			user{username, userState.Pool}, strings.Join(statuses, "; "),
+		)
+	}
+
+	return nil
+}
+
+func handleRollback(args map[string]interface{}) error {
+	var (
+		stateDir       = args["--state-dir"].(string)
+		timestamp, _   = args["--to"].(string)
+		rawLockTimeout = args["--lock-timeout"].(string)
+	)
+
+	lockTimeout, err := time.ParseDuration(rawLockTimeout)
+	if err != nil {
+		return hierr.Errorf(err, "invalid lock timeout %q", rawLockTimeout)
+	}
+
+	err = RecoverTransaction(stateDir, lockTimeout)
+	if err != nil {
+		return err
+	}
+
+	// backups are rotated only by pull runs, so rollback never removes the
+	// backup which is going to be restored.
+	backups := NewBackupStore(stateDir, 0)
+
+	if args["--list"].(bool) {
+		list, err := backups.List()
+		if err != nil {
+			return hierr.Errorf(err, "can't list backups")
+		}
+
+		if len(list) == 0 {
+			fmt.Println("no backups")
+			return nil
+		}
+
+		for _, backup := range list {
+			for _, file := range backup.Files {
+				fmt.Printf("%s: %s\n", backup.Timestamp, file.Path)
+			}
+		}
+
+		return nil
+	}
+
+	backup, err := backups.Get(timestamp)
+	if err != nil {
+		return err
+	}
+
+	// current versions of restored files are saved into new backup, so
+	// rollback can be reverted as well.
+	current := backups.Create()
+
+	backupKinds := []string{}
+	for _, file := range backup.Files {
+		backupKinds = append(backupKinds, file.Kind)
+	}
+
+	// files are restored in one transaction, so interrupted rollback never
+	// leaves files from different points in time.
+	transaction, err := NewTransaction(
+		stateDir, lockTimeout, current, backupKinds...,
+	)
+	if err != nil {
+		return err
+	}
+	defer transaction.Abort()
+
+	infof("restoring backup %s", backup.Timestamp)
+
+	err = backup.Restore(transaction)
+	if err != nil {
+		return err
+	}
+
+	err = updateStateAfterRollback(stateDir, backup, transaction)
+	if err != nil {
+		return hierr.Errorf(err, "can't update state")
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range backup.Files {
+		infof("%s restored from backup %s", file.Path, backup.Timestamp)
+	}
+
+	if len(current.Files) > 0 {
+		infof(
+			"previous versions of restored files are saved into backup %s",
+			current.Timestamp,
+		)
+	}
+
+	return nil
+}
+
+// updateStateAfterRollback makes state consistent with restored files:
+// state is restored along with files if backup contains it, otherwise
+// records about restored files are removed from the state, which is staged
+// into the same transaction.
+func updateStateAfterRollback(
+	stateDir string, backup *Backup, transaction *Transaction,
+) error {
+	for _, file := range backup.Files {
+		if file.Kind == BackupKindState {
+			return nil
+		}
+	}
+
+	state, err := LoadState(stateDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range backup.Files {
+		state.ForgetFile(file.Path, file.Kind)
+	}
+
+	return state.Stage(transaction, time.Now())
+}
+
+func handleCheckPassword(args map[string]interface{}) error {
+	var (
+		username          = args["--user"].([]string)[0]
+		pool, _           = args["--pool"].(string)
+		shadowFilepath    = args["--shadow"].(string)
+		shouldCheckRemote = args["--remote"].(bool)
+	)
+
+	if username == "" {
+		return errors.New("username can't be empty")
+	}
+
+	shadowFile, err := ReadShadowFile(shadowFilepath)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't read shadow file %s", shadowFilepath,
+		)
+	}
+
+	hash, err := shadowFile.GetHash(username)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(hash, "$") {
+		return fmt.Errorf(
+			"user %s has no password in shadow file %s",
+			username, shadowFilepath,
+		)
+	}
+
+	password, err := getPassword("Password: ")
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't prompt for password",
+		)
+	}
+
+	if !isPasswordMatch(password, hash) {
+		return fmt.Errorf(
+			"specified password does not match shadow entry "+
+				"of user %s in %s",
+			username, shadowFilepath,
+		)
+	}
+
+	infof(
+		"specified password matches shadow entry of user %s in %s",
+		username, shadowFilepath,
+	)
+
+	if !shouldCheckRemote {
+		return nil
+	}
+
+	upstream, err := newShadowdUpstream(args)
+	if err != nil {
+		return err
+	}
+
+	infof("retrieving shadow salts")
+
+	salts, err := getPasswordChangeSalts(upstream, pool, username)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't retrieve salts for %s", user{username, pool},
+		)
+	}
+
+	for _, salt := range salts {
+		if crypt(password, salt) == hash {
+			infof(
+				"shadow entry is generated from the current hash table "+
+					"of %s",
+				user{username, pool},
+			)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf(
+		"shadow entry of user %s in %s is not generated "+
+			"from the current hash table of %s, "+
+			"password may be changed on shadowd servers",
+		username, shadowFilepath, user{username, pool},
+	)
+}
+
+func handlePull(
+	upstream *ShadowdUpstream, args map[string]interface{},
+) error {
+	var (
+		shadowFilepath         = args["--shadow"].(string)
+		useUsersFromShadowFile = args["--update"].(bool)
+		useUsersFromRemotePool = args["--all"].(bool)
+		shouldCreateUser       = args["--create"].(bool)
+		shouldUpdateSSHKeys    = args["--keys"].(bool)
+		useraddArgs            = args["--useradd"].(string)
+		passwdFilePath         = args["--passwd"].(string)
+		pool, _                = args["--pool"].(string)
+		stateDir               = args["--state-dir"].(string)
+		queueKeyPath           = args["--queue-key"].(string)
+
+		authorizedKeysMode = AuthorizedKeysModeAppend
+		authorizedKeysPath = args["--keys-path"].(string)
+
+		shouldRepairPermissions = args["--repair-permissions"].(bool)
+
+		shouldUpdatePrincipals = args["--principals"].(bool)
+		principalsPath         = args["--principals-path"].(string)
+		caKeysPath             = args["--ca-keys-path"].(string)
+
+		revokedKeysPath, _ = args["--revoked-keys"].(string)
+		rawLockTimeout     = args["--lock-timeout"].(string)
+		rawBackupsAmount   = args["--backups"].(string)
+		shouldBackupKeys   = args["--backup-keys"].(bool)
+		replayAction       = args["--on-replay"].(string)
+	)
+
+	keyOptionsRules, keyPolicy, err := getSSHKeyRestrictions(args)
+	if err != nil {
+		return err
+	}
+
+	lockTimeout, err := time.ParseDuration(rawLockTimeout)
+	if err != nil {
+		return hierr.Errorf(err, "invalid lock timeout %q", rawLockTimeout)
+	}
+
+	backupsAmount, err := strconv.Atoi(rawBackupsAmount)
+	if err != nil || backupsAmount < 0 {
+		return fmt.Errorf("invalid amount of backups %q", rawBackupsAmount)
+	}
+
+	if !isValidReplayAction(replayAction) {
+		return fmt.Errorf("invalid replay action %q", replayAction)
+	}
+
+	err = RecoverTransaction(stateDir, lockTimeout)
+	if err != nil {
+		return err
+	}
+
+	state, err := LoadState(stateDir)
+	if err != nil {
+		return err
+	}
+
+	// state is saved along with other files, so rollback restores state
+	// which describes restored files.
+	backupKinds := []string{BackupKindShadow, BackupKindState}
+	if shouldBackupKeys {
+		backupKinds = append(backupKinds, BackupKindAuthorizedKeys)
+	}
+
+	var backup *Backup
+	if backupsAmount > 0 {
+		backups := NewBackupStore(stateDir, backupsAmount)
+		backup = backups.Create()
+		defer func() {
+			err := backups.Rotate()
+			if err != nil {
+				warningh(err, "can't remove old backups")
+			}
+		}()
+	}
+
+	switch {
+	case args["--overwrite-keys"].(bool):
+		authorizedKeysMode = AuthorizedKeysModeOverwrite
+
+	case args["--managed-keys"].(bool):
+		authorizedKeysMode = AuthorizedKeysModeManaged
+	}
+
+	// queued password changes are submitted after the pull, so their
+	// failures can't affect retrieving shadow entries and keys.
+	defer func() {
+		err := submitQueuedPasswordChanges(
+			upstream, NewPasswordChangeQueue(stateDir), queueKeyPath,
+		)
+		if err != nil {
+			errorh(err, "can't submit queued password changes")
+		}
+	}()
+
+	var usernames []string
+	switch {
+	case useUsersFromShadowFile:
+		infof(
+			"retrieving users with passwords from shadow file %s",
+			shadowFilepath,
+		)
+
+		var err error
+		usernames, err = getUsersWithPasswords(shadowFilepath)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't extract users from shadow file %s", shadowFilepath,
+			)
+		}
+
+	case useUsersFromRemotePool:
+		infof(
+			"retrieving users from remote pool %s",
+			pool,
+		)
+
+		var err error
+		usernames, err = getAllUsersFromPool(pool, upstream)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't retrieve users within pool %s", pool,
+			)
+		}
+
+	default:
+		usernames = args["--user"].([]string)
+		for _, username := range usernames {
+			if username == "" {
+				return errors.New("username can't be empty")
+			}
+		}
+	}
+
+	infof(
+		"retrieving shadow entries for %s",
+		users{usernames, pool},
+	)
+
+	shadows, err := getShadows(
+		usernames, upstream, pool, useUsersFromShadowFile,
+	)
+	if err != nil {
+		return hierr.Errorf(err, "can't retrieve shadow entries")
+	}
+
+	shadows, replayedUsers := checkReplayedHashes(
+		shadows, state, pool, replayAction,
+	)
+
+	infof(
+		"retrieving ssh keys for %s",
+		users{usernames, pool},
+	)
+
+	authorizedKeys, keysServers, unknownKeysUsers, err := getAuthorizedKeys(
+		usernames, upstream, pool,
+	)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't retrieve authorized keys for %s",
+			users{usernames, pool},
+		)
+	}
+
+	if authorizedKeysMode == AuthorizedKeysModeManaged {
+		// keys which have been removed on shadowd should be removed from
+		// the managed block as well.
+		for _, username := range unknownKeysUsers {
+			authorizedKeys[username] = SSHKeys{}
+		}
+	}
+
+	authorizedKeys, conflictingKeys := keyOptionsRules.Apply(
+		authorizedKeys, pool,
+	)
+
+	authorizedKeys, rejectedKeys := keyPolicy.Filter(authorizedKeys)
+
+	rejectedKeys += conflictingKeys
+
+	authorizedKeys, expiredKeys := FilterExpiredSSHKeys(
+		authorizedKeys, time.Now(),
+	)
+
+	var revokedKeys SSHKeys
+	if revokedKeysPath != "" {
+		revokedKeys, err = getRevokedSSHKeys(upstream, pool)
+		if err != nil {
+			return hierr.Errorf(err, "can't retrieve revoked ssh keys")
+		}
+
+		authorizedKeys, _ = FilterRevokedSSHKeys(authorizedKeys, revokedKeys)
+	}
+
+	var (
+		principals map[string]SSHPrincipals
+		caKeys     SSHKeys
+	)
+
+	if shouldUpdatePrincipals {
+		principals, err = getSSHPrincipals(usernames, upstream, pool)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't retrieve ssh principals for %s",
+				users{usernames, pool},
+			)
+		}
+
+		caKeys, err = getSSHCAKeys(upstream, pool)
+		if err != nil {
+			return hierr.Errorf(err, "can't retrieve ssh CA keys")
+		}
+	}
+
+	// all changes are prepared before any of them is installed, so failure
+	// does not leave some users with new keys, but old hashes.
+	transaction, err := NewTransaction(
+		stateDir, lockTimeout, backup, backupKinds...,
+	)
+	if err != nil {
+		return err
+	}
+	defer transaction.Abort()
+
+	if shouldCreateUser {
+		infof("reading shadow file %s", shadowFilepath)
+
+		shadowFile, err := ReadShadowFile(shadowFilepath)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't read shadow file %s", shadowFilepath,
+			)
+		}
+
+		passwdUsers, err := getPasswdUsers(passwdFilePath)
+		if err != nil {
+			return err
+		}
+
+		for _, shadow := range *shadows {
+			// user which exists in passwd file, but is missing in shadow
+			// file, gets new shadow entry instead of useradd.
+			if !shadowFile.HasUser(shadow.Username) &&
+				!passwdUsers[shadow.Username] {
+				infof("creating user %s", shadow.Username)
+
+				err := transaction.CreateUser(shadow.Username, useraddArgs)
+				if err != nil {
+					return hierr.Errorf(
+						err, "can't create user %s", shadow.Username,
+					)
+				}
+
+				state.GetUser(shadow.Username, pool).SetCreated(time.Now())
+			}
+		}
+	}
+
+	if revokedKeys != nil {
+		err = writeRootSSHKeysFile(revokedKeys, revokedKeysPath, transaction)
+		if err != nil {
+			return err
+		}
+
+		infof(
+			"%d revoked ssh keys written to %s",
+			len(revokedKeys), revokedKeysPath,
+		)
+	} else if revokedKeysPath != "" {
+		warningf(
+			"no revoked ssh keys found, leaving %s untouched",
+			revokedKeysPath,
+		)
+	}
+
+	var (
+		written         int
+		keysLocations   []authorizedKeysLocation
+		failedKeysUsers []string
+
+		failedPrincipalsUsers []string
+	)
+
+	if shouldUpdateSSHKeys {
+		infof("updating %d ssh keys", len(authorizedKeys))
+
+		written, keysLocations, failedKeysUsers, err = writeSSHKeys(
+			usernames, authorizedKeys, passwdFilePath,
+			authorizedKeysPath, authorizedKeysMode,
+			revokedKeys, transaction,
+		)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't update ssh keys",
+			)
+		}
+	}
+
+	if shouldUpdatePrincipals {
+		infof("updating ssh principals of %d users", len(principals))
+
+		failedPrincipalsUsers, err = writeSSHPrincipals(
+			usernames, principals, passwdFilePath, principalsPath,
+			transaction,
+		)
+		if err != nil {
+			return hierr.Errorf(err, "can't update ssh principals")
+		}
+
+		if caKeys == nil {
+			warningf(
+				"no ssh CA keys found, leaving %s untouched", caKeysPath,
+			)
+		} else {
+			err = writeRootSSHKeysFile(caKeys, caKeysPath, transaction)
+			if err != nil {
+				return err
+			}
+
+			infof("%d ssh CA keys written to %s", len(caKeys), caKeysPath)
+		}
+	}
+
+	// shadow file is staged after all other files, because shadow file
+	// lock is held until commit and blocks passwd, useradd and others.
+	// Users which shadow entries can't be updated are reported after all
+	// other changes are made.
+	var failedUsers []string
+
+	if len(*shadows) > 0 {
+		failedUsers, err = updateShadowFile(
+			shadows, shadowFilepath, passwdFilePath, transaction,
+		)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't write shadow entries to %s", shadowFilepath,
+			)
+		}
+	}
+
+	localUsers, err := getPasswdUsers(passwdFilePath)
+	if err != nil {
+		return err
+	}
+
+	state.Prune(pool, usernames, useUsersFromRemotePool, localUsers)
+
+	updateState(
+		state, pool, shadows, failedUsers, authorizedKeys, keysServers,
+		keysLocations,
+	)
+
+	err = state.Stage(transaction, time.Now())
+	if err != nil {
+		return hierr.Errorf(err, "can't update state")
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return err
+	}
+
+	if shouldUpdateSSHKeys {
+		// sshd checks permissions of installed files, so they are verified
+		// only after commit.
+		ignoredUsers := checkAuthorizedKeysLocations(
+			keysLocations, shouldRepairPermissions,
+		)
+
+		if len(ignoredUsers) > 0 {
+			errorf(
+				"ssh keys written: %d new, %d already installed, "+
+					"%d rejected by policy, %d expired, but sshd will ignore "+
+					"keys of %d users because of insecure permissions: %s",
+				written, len(authorizedKeys)-written, rejectedKeys,
+				expiredKeys,
+				len(ignoredUsers), strings.Join(ignoredUsers, ", "),
+			)
+		} else {
+			infof(
+				"ssh keys updated: %d new, %d already installed, "+
+					"%d rejected by policy, %d expired",
+				written, len(authorizedKeys)-written, rejectedKeys,
+				expiredKeys,
+			)
+		}
+	}
+
+	// all problems are reported at once, so failure of one kind does not
+	// hide others.
+	failures := []string{}
+
+	if len(replayedUsers) > 0 {
+		failures = append(failures, fmt.Sprintf(
+			"replayed hashes received for %d users, hashes are not "+
+				"installed: %s",
+			len(replayedUsers), strings.Join(replayedUsers, ", "),
+		))
+	}
+
+	if len(failedUsers) > 0 {
+		failures = append(failures, fmt.Sprintf(
+			"can't update shadow entries of %d users: %s",
+			len(failedUsers), strings.Join(failedUsers, ", "),
+		))
+	}
+
+	if len(failedKeysUsers) > 0 {
+		failures = append(failures, fmt.Sprintf(
+			"can't update ssh keys of %d users: %s",
+			len(failedKeysUsers), strings.Join(failedKeysUsers, ", "),
+		))
+	}
+
+	if len(failedPrincipalsUsers) > 0 {
+		failures = append(failures, fmt.Sprintf(
+			"can't update ssh principals of %d users: %s",
+			len(failedPrincipalsUsers),
+			strings.Join(failedPrincipalsUsers, ", "),
+		))
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// updateState records installed hashes and ssh keys into the state.
+func updateState(
+	state *State, pool string, shadows *Shadows, failedUsers []string,
+	keys AuthorizedKeys, keysServers map[string]string,
+	keysLocations []authorizedKeysLocation,
+) {
+	now := time.Now()
+
+	failed := map[string]bool{}
+	for _, username := range failedUsers {
+		failed[username] = true
+	}
+
+	for _, shadow := range *shadows {
+		if !failed[shadow.Username] {
+			state.GetUser(shadow.Username, pool).SetHash(
+				shadow.Hash, shadow.Server, now,
+			)
+		}
+	}
+
+	for _, location := range keysLocations {
+		state.GetUser(location.user, pool).SetKeys(
+			location.path, keys[location.user],
+			keysServers[location.user], now,
+		)
+	}
+}
+
+func getSSHKeyRestrictions(
+	args map[string]interface{},
+) (SSHKeyOptionsRules, *SSHKeyPolicy, error) {
+	var (
+		deniedKeyTypes, _     = args["--deny-key-types"].(string)
+		minRSABits, _         = args["--min-rsa-bits"].(string)
+		requiredKeyOptions, _ = args["--require-key-options"].(string)
+		onlySKKeys            = args["--sk-keys-only"].(bool)
+		keyOptionsPath        = args["--key-options"].(string)
+	)
+
+	keyPolicy, err := NewSSHKeyPolicy(
+		deniedKeyTypes, minRSABits, requiredKeyOptions, onlySKKeys,
+	)
+	if err != nil {
+		return nil, nil, hierr.Errorf(err, "invalid SSH key policy")
+	}
+
+	keyOptionsRules, err := ReadSSHKeyOptionsRules(keyOptionsPath)
+	if err != nil {
+		return nil, nil, hierr.Errorf(
+			err, "can't read SSH key options file %s", keyOptionsPath,
+		)
+	}
+
+	return keyOptionsRules, keyPolicy, nil
+}
+
+func getPasswordChangeSalts(
+	upstream *ShadowdUpstream, pool, username string,
+) ([]string, error) {
+	shadowdHosts, err := upstream.GetAliveShadowdHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, shadowdHost := range shadowdHosts {
+		salts, err := shadowdHost.GetPasswordChangeSalts(pool, username)
+		if err != nil {
+			switch err.(type) {
+			case NotFoundError:
+				warningf(
+					"[%s] is not aware of %s",
+					shadowdHost.GetAddr(), user{username, pool},
+				)
+
+			default:
+				shadowdHost.SetIsAlive(false)
+
+				errorh(
+					err,
+					"[%s] has gone away", shadowdHost.GetAddr(),
+				)
+			}
+
+			continue
+		}
+
+		return salts, nil
+	}
+
+	return nil, fmt.Errorf(
+		"no information available for %s in all shadowd servers",
+		user{username, pool},
+	)
+}
+
+func changePassword(
+	upstream *ShadowdUpstream,
+	pool, username string, shadows []string, password string,
+) error {
+	shadowdHosts, err := upstream.GetAliveShadowdHosts()
+	if err != nil {
+		return err
+	}
+
+	tracef("shadows: %q", shadows)
+
+	for _, shadowdHost := range shadowdHosts {
 		err = shadowdHost.ChangePassword(
 			pool, username, shadows, password,
 		)
@@ -442,136 +1451,551 @@ func changePassword(
 			continue
 		}
 
-		return nil
+		return nil
+	}
+
+	return errors.New("can't change password")
+}
+
+type shadowdHostSalts struct {
+	host  *ShadowdHost
+	salts []string
+}
+
+// changePasswordOnAllServers changes password on every shadowd server which
+// is aware of the user, amount of servers which accepted change is returned
+// even if quorum is not reached.
+func changePasswordOnAllServers(
+	upstream *ShadowdUpstream,
+	pool, username string, oldpassword, password string,
+	quorum int,
+) (int, error) {
+	shadowdHosts, err := upstream.GetAliveShadowdHosts()
+	if err != nil {
+		return 0, err
+	}
+
+	required := quorum
+	if required == 0 {
+		required = len(shadowdHosts)
+	}
+
+	if required > len(shadowdHosts) {
+		return 0, fmt.Errorf(
+			"quorum of %d servers can't be reached, "+
+				"only %d shadowd servers specified",
+			required, len(shadowdHosts),
+		)
+	}
+
+	infof("retrieving shadow salts from all shadowd servers")
+
+	hostsSalts, err := getPasswordChangeSaltsFromAllServers(
+		shadowdHosts, pool, username,
+	)
+	if err != nil {
+		return 0, hierr.Errorf(
+			err, "can't retrieve salts for changing password",
+		)
+	}
+
+	if len(hostsSalts) < required {
+		return 0, fmt.Errorf(
+			"quorum of %d servers can't be reached, "+
+				"only %d shadowd servers are aware of %s",
+			required, len(hostsSalts), user{username, pool},
+		)
+	}
+
+	infof(
+		"requesting hash table generating with new password "+
+			"on %d shadowd servers",
+		len(hostsSalts),
+	)
+
+	changed := 0
+	for _, hostSalts := range hostsSalts {
+		shadowdHost := hostSalts.host
+
+		err := shadowdHost.ChangePassword(
+			pool, username,
+			getProofShadows(oldpassword, hostSalts.salts),
+			password,
+		)
+		if err != nil {
+			switch err.(type) {
+			case NotFoundError:
+				warningf(
+					"[%s] is not aware of %s",
+					shadowdHost.GetAddr(), user{username, pool},
+				)
+
+			default:
+				shadowdHost.SetIsAlive(false)
+
+				errorh(
+					err,
+					"[%s] can't change password", shadowdHost.GetAddr(),
+				)
+			}
+
+			continue
+		}
+
+		infof(
+			"[%s] hash table for %s generated",
+			shadowdHost.GetAddr(), user{username, pool},
+		)
+
+		changed++
+	}
+
+	if changed > 0 && changed < len(shadowdHosts) {
+		warningf(
+			"[!] password for %s has been changed only on %d of %d "+
+				"shadowd servers; change is partially applied and "+
+				"password will differ depending on server",
+			user{username, pool}, changed, len(shadowdHosts),
+		)
+	}
+
+	if changed < required {
+		return changed, fmt.Errorf(
+			"password for %s has been changed on %d shadowd servers, "+
+				"but quorum of %d servers is not reached",
+			user{username, pool}, changed, required,
+		)
+	}
+
+	return changed, nil
+}
+
+func getPasswordChangeSaltsFromAllServers(
+	shadowdHosts []*ShadowdHost, pool, username string,
+) ([]shadowdHostSalts, error) {
+	hostsSalts := []shadowdHostSalts{}
+
+	for _, shadowdHost := range shadowdHosts {
+		salts, err := shadowdHost.GetPasswordChangeSalts(pool, username)
+		if err != nil {
+			switch err.(type) {
+			case NotFoundError:
+				warningf(
+					"[%s] is not aware of %s",
+					shadowdHost.GetAddr(), user{username, pool},
+				)
+
+			default:
+				shadowdHost.SetIsAlive(false)
+
+				errorh(
+					err,
+					"[%s] has gone away", shadowdHost.GetAddr(),
+				)
+			}
+
+			continue
+		}
+
+		hostsSalts = append(hostsSalts, shadowdHostSalts{
+			host:  shadowdHost,
+			salts: salts,
+		})
 	}
 
-	return errors.New("can't change password")
+	if len(hostsSalts) == 0 {
+		return nil, fmt.Errorf(
+			"no information available for %s in all shadowd servers",
+			user{username, pool},
+		)
+	}
+
+	for _, hostSalts := range hostsSalts[1:] {
+		if !isSaltsEqual(hostsSalts[0].salts, hostSalts.salts) {
+			warningf(
+				"[!] salts for %s on [%s] differ from salts on [%s]; "+
+					"hash tables are not consistent across servers",
+				user{username, pool},
+				hostSalts.host.GetAddr(), hostsSalts[0].host.GetAddr(),
+			)
+		}
+	}
+
+	return hostsSalts, nil
 }
 
-func writeShadows(shadows *Shadows, shadowFile *ShadowFile) error {
-	// create temporary file in same directory for preventing 'cross-device
-	// link' error.
-	temporaryFile, err := ioutil.TempFile(
-		path.Dir(shadowFile.GetPath()), "shadow",
-	)
+func isSaltsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+
+	sort.Strings(a)
+	sort.Strings(b)
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func getProofShadows(password string, salts []string) []string {
+	shadows := []string{}
+	for _, salt := range salts {
+		shadows = append(shadows, crypt(password, salt))
+	}
+
+	return shadows
+}
+
+// updateShadowFile stages shadow entries into shadow file while holding
+// the lock used by shadow-utils, so concurrent passwd, useradd or chage do
+// not lose their changes. File is read only after the lock is acquired and
+// the lock is held until transaction is finished.
+func updateShadowFile(
+	shadows *Shadows, shadowFilepath string, passwdFilePath string,
+	transaction *Transaction,
+) ([]string, error) {
+	err := transaction.LockShadowFile(shadowFilepath)
 	if err != nil {
-		return hierr.Errorf(
-			err, "can't create temporary file",
+		return nil, err
+	}
+
+	infof("reading shadow file %s", shadowFilepath)
+
+	shadowFile, err := ReadShadowFile(shadowFilepath)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err, "can't read shadow file %s", shadowFilepath,
 		)
 	}
-	defer temporaryFile.Close()
+
+	err = shadowFile.Validate()
+	if err != nil {
+		warningh(err, "malformed lines will be kept as is")
+	}
+
+	passwdUsers, err := getPasswdUsers(passwdFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	infof("updating %d shadow entries", len(*shadows))
+
+	return writeShadows(shadows, shadowFile, passwdUsers, transaction)
+}
+
+// writeShadows updates shadow entries and stages new shadow file. Users
+// which are listed in passwd file, but are missing in shadow file, get new
+// entries. Failure to update one user does not prevent updating others,
+// names of users which are not updated are returned.
+func writeShadows(
+	shadows *Shadows, shadowFile *ShadowFile, passwdUsers map[string]bool,
+	transaction *Transaction,
+) ([]string, error) {
+	failedUsers := []string{}
+	updated, added := 0, 0
 
 	for _, shadow := range *shadows {
-		err := shadowFile.SetShadow(shadow)
-		if err != nil {
-			return hierr.Errorf(
-				err, "can't set shadow record for user %s",
+		var err error
+
+		switch {
+		case shadowFile.HasUser(shadow.Username):
+			err = shadowFile.SetShadow(shadow)
+			if err == nil {
+				debugf("shadow entry of user %s updated", shadow.Username)
+				updated++
+			}
+
+		case passwdUsers[shadow.Username]:
+			err = shadowFile.AddShadow(shadow)
+			if err == nil {
+				infof(
+					"user %s is missing in shadow file, entry added",
+					shadow.Username,
+				)
+				added++
+			}
+
+		default:
+			err = fmt.Errorf(
+				"user %s is not found in passwd and shadow files",
 				shadow.Username,
 			)
 		}
+
+		if err != nil {
+			errorh(
+				err, "can't set shadow entry for user %s", shadow.Username,
+			)
+
+			failedUsers = append(failedUsers, shadow.Username)
+		}
 	}
 
-	_, err = shadowFile.Write(temporaryFile)
-	if err != nil {
-		return hierr.Errorf(
-			err, "can't write temporary shadow file",
-		)
+	if updated+added == 0 {
+		return failedUsers, nil
 	}
 
-	err = temporaryFile.Close()
+	dir, err := OpenSecureDirectory(
+		filepath.Dir(shadowFile.GetPath()), 0, 0, 0755,
+	)
 	if err != nil {
-		return hierr.Errorf(
-			err, "can't close temporary shadow file",
-		)
+		return nil, err
 	}
+	defer dir.Close()
 
-	err = os.Rename(temporaryFile.Name(), shadowFile.GetPath())
+	err = transaction.Stage(
+		dir, filepath.Base(shadowFile.GetPath()), BackupKindShadow, 0600,
+		shadowFile, validateShadowFile(shadowFile),
+	)
 	if err != nil {
-		return hierr.Errorf(
-			err,
-			"can't rename temporary file (%s) to shadow file (%s)",
-			temporaryFile.Name(), shadowFile.GetPath(),
-		)
+		return nil, hierr.Errorf(err, "can't stage shadow file")
 	}
 
-	return nil
+	infof(
+		"shadow entries updated: %d updated, %d added, %d failed",
+		updated, added, len(failedUsers),
+	)
+
+	return failedUsers, nil
+}
+
+// validateShadowFile returns function which verifies that staged shadow
+// file contains exactly the same entries as the parsed one, so hash which
+// contains separators can't produce extra or broken entries.
+func validateShadowFile(shadowFile *ShadowFile) func([]byte) error {
+	return func(contents []byte) error {
+		entries := shadowFile.GetEntries()
+		staged := ParseShadowFile(string(contents), shadowFile.GetPath())
+
+		if len(staged.GetEntries()) != len(entries) {
+			return fmt.Errorf(
+				"%d entries expected, but %d found",
+				len(entries), len(staged.GetEntries()),
+			)
+		}
+
+		for _, entry := range entries {
+			stagedEntry := staged.GetEntry(entry.Username)
+			if stagedEntry == nil || stagedEntry.String() != entry.String() {
+				return fmt.Errorf(
+					"entry of user %s is malformed", entry.Username,
+				)
+			}
+		}
+
+		return nil
+	}
 }
 
+// authorizedKeysLocation is authorized_keys file of the user along with
+// home directory, which is needed for checking StrictModes requirements.
+// Files outside of home directories are owned by root.
+type authorizedKeysLocation struct {
+	user        string
+	path        string
+	home        string
+	isUserOwned bool
+}
+
+// writeSSHKeys stages authorized_keys files of specified users. Failure to
+// update one user does not prevent updating others, so user can't stop
+// distribution of hashes and keys by breaking own authorized_keys file,
+// names of users which keys are not updated are returned.
 func writeSSHKeys(
 	usernames []string, keys AuthorizedKeys, passwdFilePath string,
-	shouldOverwriteAuthorizedKeys bool,
-) (int, error) {
+	pathTemplate string, mode AuthorizedKeysMode,
+	revokedKeys SSHKeys, transaction *Transaction,
+) (int, []authorizedKeysLocation, []string, error) {
 	homeDirs, err := getUsersHomeDirs(passwdFilePath)
 	if err != nil {
-		return 0, hierr.Errorf(
+		return 0, nil, nil, hierr.Errorf(
 			err, "can't get users home directories from passwd file %s",
 			passwdFilePath,
 		)
 	}
 
+	// relative paths are relative to home directory, like sshd does.
+	if !strings.HasPrefix(pathTemplate, "/") {
+		pathTemplate = "%h/" + pathTemplate
+	}
+
+	// keys written outside of home directories are owned by root, so users
+	// can't tamper with them.
+	isUserOwned := strings.Contains(pathTemplate, "%h")
+
 	total := 0
+	locations := []authorizedKeysLocation{}
+	failedUsers := []string{}
 
 	for _, user := range usernames {
-		key, ok := keys[user]
-		if !ok {
+		key, hasKeys := keys[user]
+		if !hasKeys && len(revokedKeys) == 0 {
 			continue
 		}
 
 		home, ok := homeDirs[user]
-		if !ok {
+		if !ok && isUserOwned {
 			infof("no home directory found for user %s, skipping", user)
 			continue
 		}
 
-		path := filepath.Join(
-			home, ".ssh", "authorized_keys",
-		)
+		path, err := expandAuthorizedKeysPath(pathTemplate, user, home)
+		if err != nil {
+			errorh(
+				err, "can't get authorized keys file path for user %s",
+				user,
+			)
+
+			failedUsers = append(failedUsers, user)
+			continue
+		}
+
+		if !hasKeys {
+			// shadowd is not aware of user keys, but revoked keys should be
+			// removed anyway.
+			err = removeRevokedSSHKeys(
+				user, path, isUserOwned, revokedKeys, transaction,
+			)
+			if err != nil {
+				errorh(err, "can't remove revoked ssh keys of user %s", user)
+
+				failedUsers = append(failedUsers, user)
+			}
+
+			continue
+		}
 
 		written, err := writeAuthorizedKeysFile(
-			user, path, key, shouldOverwriteAuthorizedKeys,
+			user, path, key, mode, isUserOwned, revokedKeys, transaction,
 		)
 		if err != nil {
-			return total, hierr.Errorf(
-				err, "can't update user %s ssh keys", user,
-			)
+			if os.IsNotExist(err) && len(key) == 0 {
+				continue
+			}
+
+			errorh(err, "can't update ssh keys of user %s", user)
+
+			failedUsers = append(failedUsers, user)
+			continue
 		}
 
 		total += written
+
+		locations = append(locations, authorizedKeysLocation{
+			user:        user,
+			path:        path,
+			home:        home,
+			isUserOwned: isUserOwned,
+		})
+	}
+
+	if len(revokedKeys) > 0 {
+		err = removeRevokedSSHKeysOfLocalUsers(
+			usernames, passwdFilePath, homeDirs, pathTemplate, isUserOwned,
+			revokedKeys, transaction,
+		)
+		if err != nil {
+			return total, locations, failedUsers, err
+		}
+	}
+
+	return total, locations, failedUsers, nil
+}
+
+// checkAuthorizedKeysLocations returns users which authorized_keys files
+// will be ignored by sshd with StrictModes enabled.
+func checkAuthorizedKeysLocations(
+	locations []authorizedKeysLocation, repair bool,
+) []string {
+	ignoredUsers := []string{}
+	for _, location := range locations {
+		if !isStrictModesSatisfied(location, repair) {
+			ignoredUsers = append(ignoredUsers, location.user)
+		}
+	}
+
+	return ignoredUsers
+}
+
+// isStrictModesSatisfied reports whether sshd with StrictModes enabled will
+// accept authorized_keys file of specified user, all found problems are
+// logged. Files are expected to be owned by the same user which shadowc
+// writes them on behalf of: the user for files in home directory and root
+// for others.
+func isStrictModesSatisfied(
+	location authorizedKeysLocation, repair bool,
+) bool {
+	var (
+		uid, gid = 0, 0
+		err      error
+	)
+
+	if location.isUserOwned {
+		uid, gid, err = lookupUser(location.user)
+	}
+
+	if err == nil {
+		var problems []string
+		problems, err = checkStrictModes(
+			location.path, location.home, uid, gid, repair,
+		)
+		if err == nil {
+			for _, problem := range problems {
+				errorf(
+					"sshd will ignore ssh keys of user %s: %s",
+					location.user, problem,
+				)
+			}
+
+			return len(problems) == 0
+		}
 	}
 
-	return total, nil
+	errorh(
+		err, "can't verify permissions of %s, sshd may ignore ssh keys "+
+			"of user %s", location.path, location.user,
+	)
+
+	return false
 }
 
 func writeAuthorizedKeysFile(
 	user string,
 	path string, sshKeys SSHKeys,
-	shouldOverwrite bool,
+	mode AuthorizedKeysMode,
+	isUserOwned bool,
+	revokedKeys SSHKeys,
+	transaction *Transaction,
 ) (int, error) {
-	dir := filepath.Dir(path)
-
-	_, err := os.Stat(dir)
-	if os.IsNotExist(err) {
-		err = os.MkdirAll(dir, 0700)
-		if err != nil {
-			return 0, hierr.Errorf(
-				err, "can't create directory at %s", dir,
-			)
-		}
-
-		err = changeOwner(user, dir)
-		if err != nil {
-			return 0, hierr.Errorf(
-				err, "can't change directory %s owner to %s", dir, user,
-			)
-		}
+	// there is nothing to add for user without keys, so missing file is not
+	// created and error satisfying os.IsNotExist is returned instead.
+	dir, fileMode, err := openSecureFileDirectory(
+		user, path, isUserOwned, len(sshKeys) > 0,
+	)
+	if err != nil {
+		return 0, err
 	}
+	defer dir.Close()
+
+	name := filepath.Base(path)
 
 	var authorizedKeysFile *AuthorizedKeysFile
-	if shouldOverwrite {
+	if mode == AuthorizedKeysModeOverwrite {
 		authorizedKeysFile = NewAuthorizedKeysFile(path)
 	} else {
-		authorizedKeysFile, err = ReadAuthorizedKeysFile(path)
+		authorizedKeysFile, err = readSecureAuthorizedKeysFile(dir, name)
 		if err != nil {
+			if os.IsNotExist(err) && len(sshKeys) == 0 {
+				return 0, err
+			}
+
 			if os.IsNotExist(err) {
 				authorizedKeysFile = NewAuthorizedKeysFile(path)
 			} else {
@@ -582,57 +2006,181 @@ func writeAuthorizedKeysFile(
 		}
 	}
 
+	// revoked keys are removed from the whole file, because they can be
+	// added by user outside of the block managed by shadowc.
+	for _, sshKey := range authorizedKeysFile.RemoveSSHKeys(revokedKeys) {
+		warningf(
+			"revoked SSH key %s removed from user %s",
+			sshKey.GetFingerprint(), user,
+		)
+	}
+
 	added := 0
-	for _, sshKey := range sshKeys {
-		success := authorizedKeysFile.AddSSHKey(sshKey)
-		if success {
+	if mode == AuthorizedKeysModeManaged {
+		addedKeys, updatedKeys, removedKeys, err :=
+			authorizedKeysFile.SetManagedSSHKeys(sshKeys)
+		if err != nil {
+			return 0, hierr.Errorf(
+				err, "can't update shadowc block in %s", path,
+			)
+		}
+
+		for _, sshKey := range addedKeys {
+			infof(
+				"SSH key %s added to user %s",
+				sshKey.GetFingerprint(), user,
+			)
+		}
+
+		for _, sshKey := range updatedKeys {
+			infof(
+				"SSH key %s updated for user %s",
+				sshKey.GetFingerprint(), user,
+			)
+		}
+
+		for _, sshKey := range removedKeys {
+			infof(
+				"SSH key %s removed from user %s",
+				sshKey.GetFingerprint(), user,
+			)
+		}
+
+		added = len(addedKeys)
+	} else {
+		// keys appended earlier are never removed, so time-limited keys
+		// would stay in the file forever.
+		expiredKeys := authorizedKeysFile.RemoveExpiredSSHKeys(time.Now())
+		for _, sshKey := range expiredKeys {
 			infof(
-				"SSH key with comment '%s' added to user %s",
-				sshKey.GetComment(), user,
+				"SSH key %s removed from user %s, because it is expired",
+				sshKey.GetFingerprint(), user,
 			)
+		}
 
-			added++
+		for _, sshKey := range sshKeys {
+			switch authorizedKeysFile.AddSSHKey(sshKey) {
+			case AuthorizedKeysChangeAdded:
+				infof(
+					"SSH key %s added to user %s",
+					sshKey.GetFingerprint(), user,
+				)
+
+				added++
+
+			case AuthorizedKeysChangeUpdated:
+				infof(
+					"SSH key %s updated for user %s",
+					sshKey.GetFingerprint(), user,
+				)
+			}
 		}
 	}
 
-	temporaryFile, err := ioutil.TempFile(dir, filepath.Base(dir))
+	err = transaction.Stage(
+		dir, name, BackupKindAuthorizedKeys, fileMode, authorizedKeysFile,
+		nil,
+	)
 	if err != nil {
-		return 0, hierr.Errorf(
-			err, "can't create temporary file at %s", dir,
-		)
+		return 0, err
 	}
 
-	_, err = authorizedKeysFile.Write(temporaryFile)
+	return added, nil
+}
+
+func readSecureAuthorizedKeysFile(
+	dir *SecureDirectory, name string,
+) (*AuthorizedKeysFile, error) {
+	file, err := dir.OpenFile(name)
 	if err != nil {
-		return 0, hierr.Errorf(
-			err, "can't write authorized_keys file",
-		)
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadAuthorizedKeys(file, file.Name())
+}
+
+// openSecureFileDirectory opens directory of the file which is read by sshd
+// on behalf of specified user and returns mode which the file should have.
+// User-owned files are written into directories owned by user, other files
+// are owned by root, so users can't tamper with them. Missing directories are
+// created only if create is true.
+func openSecureFileDirectory(
+	user string, path string, isUserOwned bool, create bool,
+) (*SecureDirectory, os.FileMode, error) {
+	var (
+		uid, gid = 0, 0
+		dirMode  = os.FileMode(0755)
+
+		// file is read by sshd on behalf of the user
+		fileMode = os.FileMode(0644)
+	)
+
+	if isUserOwned {
+		var err error
+		uid, gid, err = lookupUser(user)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		dirMode = 0700
+		fileMode = 0600
 	}
 
-	err = temporaryFile.Close()
+	// directory is opened without following symlinks, because it can be
+	// controlled by user and shadowc runs as root.
+	var (
+		dir *SecureDirectory
+		err error
+	)
+
+	if create {
+		dir, err = OpenSecureDirectory(filepath.Dir(path), uid, gid, dirMode)
+	} else {
+		dir, err = OpenExistingSecureDirectory(filepath.Dir(path), uid, gid)
+	}
 	if err != nil {
-		return 0, hierr.Errorf(
-			err, "can't close authorized_keys temporary file",
+		if os.IsNotExist(err) {
+			return nil, 0, err
+		}
+
+		return nil, 0, hierr.Errorf(
+			err, "can't open directory %s", filepath.Dir(path),
 		)
 	}
 
-	err = changeOwner(user, temporaryFile.Name())
+	return dir, fileMode, nil
+}
+
+// writeRootSSHKeysFile stages root-owned file with specified keys, such
+// files are used by sshd as TrustedUserCAKeys or RevokedKeys.
+func writeRootSSHKeysFile(
+	keys SSHKeys, path string, transaction *Transaction,
+) error {
+	dir, fileMode, err := openSecureFileDirectory("root", path, false, true)
 	if err != nil {
-		return 0, hierr.Errorf(
-			err, "can't change file %s owner to %s",
-			temporaryFile.Name(), user,
-		)
+		return err
 	}
+	defer dir.Close()
 
-	err = os.Rename(temporaryFile.Name(), path)
+	keysFile := NewAuthorizedKeysFile(path)
+	keysFile.AddComment(sshManagedFileNotice)
+	for _, key := range keys {
+		keysFile.AddSSHKey(key)
+	}
+
+	err = transaction.Stage(
+		dir, filepath.Base(path), BackupKindSSHKeys, fileMode, keysFile, nil,
+	)
 	if err != nil {
-		return 0, hierr.Errorf(
-			err, "can't rename %s to %s",
-			temporaryFile.Name(), path,
-		)
+		return hierr.Errorf(err, "can't update ssh keys file %s", path)
 	}
 
-	return added, nil
+	for _, key := range keys {
+		debugf("ssh key %s written to %s", key.GetFingerprint(), path)
+	}
+
+	return nil
 }
 
 func getShadows(
@@ -691,18 +2239,29 @@ func getShadows(
 	return &shadows, nil
 }
 
+// getAuthorizedKeys retrieves ssh keys of specified users along with
+// addresses of shadowd servers which have provided them.
 func getAuthorizedKeys(
 	usernames []string, upstream *ShadowdUpstream, pool string,
-) (AuthorizedKeys, error) {
+) (AuthorizedKeys, map[string]string, []string, error) {
 	keys := make(AuthorizedKeys)
+	servers := map[string]string{}
+
+	// users which all requested servers are not aware of, so they have no
+	// keys, unlike users which keys can't be retrieved at all.
+	unknownUsers := []string{}
 
 	for _, username := range usernames {
 		shadowdHosts, err := upstream.GetAliveShadowdHosts()
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 
-		sshKeysFound := false
+		var (
+			sshKeysFound = false
+			hostsFailed  = false
+		)
+
 		for _, shadowdHost := range shadowdHosts {
 			userKeys, err := shadowdHost.GetSSHKeys(pool, username)
 			if err != nil {
@@ -720,6 +2279,8 @@ func getAuthorizedKeys(
 					errorh(
 						err, "[%s] has gone away", shadowdHost.GetAddr(),
 					)
+
+					hostsFailed = true
 				}
 
 				continue
@@ -727,44 +2288,41 @@ func getAuthorizedKeys(
 
 			sshKeysFound = true
 			keys[username] = userKeys
+			servers[username] = shadowdHost.GetAddr()
 			break
 		}
 
+		if !sshKeysFound && !hostsFailed {
+			unknownUsers = append(unknownUsers, username)
+		}
+
 		if !sshKeysFound && len(shadowdHosts) > 1 {
 			warningf("no ssh keys found for %s", user{username, pool})
 		}
 	}
 
-	return keys, nil
+	return keys, servers, unknownUsers, nil
 }
 
 func getUsersWithPasswords(shadowFilepath string) ([]string, error) {
-	contents, err := ioutil.ReadFile(shadowFilepath)
+	shadowFile, err := ReadShadowFile(shadowFilepath)
 	if err != nil {
 		return []string{}, hierr.Errorf(
 			err, "can't read shadow file %s", shadowFilepath,
 		)
 	}
 
-	usernames := []string{}
-
-	lines := strings.Split(string(contents), "\n")
-	for number, line := range lines {
-		if line == "" {
-			continue
-		}
-
-		shadowEntry := strings.Split(line, ":")
-		if len(shadowEntry) < 2 {
-			return []string{}, hierr.Errorf(
-				errors.New(line),
-				"invalid shadow line #%d", number+1,
-			)
-		}
+	// malformed lines are reported the same way as while updating shadow
+	// file, so one broken entry does not prevent updating other users.
+	err = shadowFile.Validate()
+	if err != nil {
+		warningh(err, "malformed lines are skipped")
+	}
 
-		hash := shadowEntry[1]
-		if len(hash) > 1 && hash[0] == '$' {
-			usernames = append(usernames, shadowEntry[0])
+	usernames := []string{}
+	for _, entry := range shadowFile.GetEntries() {
+		if entry.HasPassword() {
+			usernames = append(usernames, entry.Username)
 		}
 	}
 
@@ -848,7 +2406,21 @@ func tryToResolveSRV(records []string) []string {
 	return addresses
 }
 
-func changeOwner(user, path string) error {
-	_, _, err := executil.Run(exec.Command("chown", user+":", path))
-	return err
+func lookupUser(name string) (int, int, error) {
+	account, err := osuser.Lookup(name)
+	if err != nil {
+		return 0, 0, hierr.Errorf(err, "can't lookup user %s", name)
+	}
+
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return 0, 0, hierr.Errorf(err, "invalid uid of user %s", name)
+	}
+
+	gid, err := strconv.Atoi(account.Gid)
+	if err != nil {
+		return 0, 0, hierr.Errorf(err, "invalid gid of user %s", name)
+	}
+
+	return uid, gid, nil
 }
@@ -7,6 +7,7 @@ import "C"
 
 import (
 	"bufio"
+	"crypto/subtle"
 	"fmt"
 	"os"
 	"os/exec"
@@ -19,6 +20,12 @@ func crypt(password, salt string) string {
 	return C.GoString(C.crypt(C.CString(password), C.CString(salt)))
 }
 
+func isPasswordMatch(password, hash string) bool {
+	return subtle.ConstantTimeCompare(
+		[]byte(crypt(password, hash)), []byte(hash),
+	) == 1
+}
+
 func getPassword(prompt string) (string, error) {
 	var (
 		sttyEchoDisable = exec.Command("stty", "-F", "/dev/tty", "-echo")
@@ -40,3 +40,37 @@ func getUsersHomeDirs(passwdPath string) (map[string]string, error) {
 
 	return users, nil
 }
+
+// getPasswdUsers returns names of local users listed in passwd file, NIS
+// compat lines are skipped.
+func getPasswdUsers(passwdPath string) (map[string]bool, error) {
+	file, err := os.Open(passwdPath)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err, "can't open passwd file at %s", passwdPath,
+		)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	users := make(map[string]bool)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isShadowFileComment(line) {
+			continue
+		}
+
+		users[strings.SplitN(line, ":", 2)[0]] = true
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, hierr.Errorf(
+			err, "can't read passwd file at %s", passwdPath,
+		)
+	}
+
+	return users, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	passwordStyleRandom     = "random"
+	passwordStylePassphrase = "passphrase"
+
+	defaultRandomPasswordLength     = 24
+	defaultPassphrasePasswordLength = 6
+
+	passphraseWordSyllables = 3
+)
+
+var (
+	passwordAlphabet = "abcdefghijklmnopqrstuvwxyz" +
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
+		"0123456789" +
+		"!#%+,-./:=?@^_~"
+
+	passphraseConsonants = "bcdfghjklmnprstvwz"
+	passphraseVowels     = "aeiou"
+)
+
+type passwordGenerator struct {
+	style  string
+	length int
+}
+
+func newPasswordGenerator(
+	style string, length string,
+) (*passwordGenerator, error) {
+	generator := &passwordGenerator{
+		style: style,
+	}
+
+	switch style {
+	case passwordStyleRandom:
+		generator.length = defaultRandomPasswordLength
+
+	case passwordStylePassphrase:
+		generator.length = defaultPassphrasePasswordLength
+
+	default:
+		return nil, fmt.Errorf(
+			"unknown password style %q, expected %q or %q",
+			style, passwordStyleRandom, passwordStylePassphrase,
+		)
+	}
+
+	if length != "" {
+		var err error
+		generator.length, err = strconv.Atoi(length)
+		if err != nil {
+			return nil, fmt.Errorf("invalid password length %q", length)
+		}
+
+		if generator.length < 1 {
+			return nil, fmt.Errorf(
+				"password length should be positive, got %d",
+				generator.length,
+			)
+		}
+	}
+
+	return generator, nil
+}
+
+func (generator *passwordGenerator) Generate() (string, error) {
+	if generator.style == passwordStylePassphrase {
+		return generator.generatePassphrase()
+	}
+
+	return randomString(passwordAlphabet, generator.length)
+}
+
+// Entropy returns estimated amount of entropy bits in generated password.
+func (generator *passwordGenerator) Entropy() float64 {
+	if generator.style == passwordStylePassphrase {
+		syllable := math.Log2(
+			float64(len(passphraseConsonants) * len(passphraseVowels)),
+		)
+
+		return float64(generator.length) *
+			float64(passphraseWordSyllables) * syllable
+	}
+
+	return float64(generator.length) *
+		math.Log2(float64(len(passwordAlphabet)))
+}
+
+func (generator *passwordGenerator) generatePassphrase() (string, error) {
+	words := []string{}
+	for i := 0; i < generator.length; i++ {
+		word := ""
+		for j := 0; j < passphraseWordSyllables; j++ {
+			consonant, err := randomString(passphraseConsonants, 1)
+			if err != nil {
+				return "", err
+			}
+
+			vowel, err := randomString(passphraseVowels, 1)
+			if err != nil {
+				return "", err
+			}
+
+			word += consonant + vowel
+		}
+
+		words = append(words, word)
+	}
+
+	return strings.Join(words, "-"), nil
+}
+
+func randomString(alphabet string, length int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+
+	result := make([]byte, length)
+	for i := range result {
+		index, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+
+		result[i] = alphabet[index.Int64()]
+	}
+
+	return string(result), nil
+}
+
+func openPasswordOutput(fd string) (*os.File, error) {
+	number, err := strconv.Atoi(fd)
+	if err != nil || number < 0 {
+		return nil, fmt.Errorf("invalid file descriptor %q", fd)
+	}
+
+	file := os.NewFile(uintptr(number), "fd"+fd)
+
+	_, err = file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/reconquest/hierr-go"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	passwordQueueDirName = "queue"
+
+	// queueKeySize is size of AES-256 key which encrypts queued changes.
+	queueKeySize = 32
+
+	// queuedPasswordChangeMaxAttempts limits retries of the change which
+	// can't be submitted, e.g. because shadowd servers keep failing.
+	queuedPasswordChangeMaxAttempts = 100
+)
+
+// QueuedPasswordChange is a password change which can't be submitted to
+// shadowd servers because all of them were unreachable.
+//
+// Payload contains base64 encoded GCM nonce followed by JSON object with
+// 'password' and 'new_password' fields encrypted using AES-256-GCM with the
+// queue key, which is readable only by root. Key is stored on the same host,
+// so encryption protects only from reading the queue alone, e.g. from
+// backups of the state directory, not from root.
+type QueuedPasswordChange struct {
+	Pool          string    `json:"pool"`
+	Username      string    `json:"username"`
+	CreatedAt     time.Time `json:"created_at"`
+	Attempts      int       `json:"attempts"`
+	LastAttemptAt time.Time `json:"last_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+	Payload       string    `json:"payload"`
+
+	path string
+}
+
+type PasswordChangeQueue struct {
+	dir string
+}
+
+func NewPasswordChangeQueue(stateDir string) *PasswordChangeQueue {
+	return &PasswordChangeQueue{
+		dir: filepath.Join(stateDir, passwordQueueDirName),
+	}
+}
+
+func (queue *PasswordChangeQueue) Push(change *QueuedPasswordChange) error {
+	err := os.MkdirAll(queue.dir, 0700)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't create queue directory %s", queue.dir,
+		)
+	}
+
+	change.path = filepath.Join(
+		queue.dir,
+		fmt.Sprintf(
+			"%d-%s.json",
+			change.CreatedAt.UnixNano(),
+			strings.Replace(
+				strings.Trim(change.Pool+"/"+change.Username, "/"),
+				"/", "_", -1,
+			),
+		),
+	)
+
+	return queue.Save(change)
+}
+
+func (queue *PasswordChangeQueue) Save(change *QueuedPasswordChange) error {
+	data, err := json.MarshalIndent(change, "", "  ")
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't encode queued password change",
+		)
+	}
+
+	temporaryFile, err := ioutil.TempFile(queue.dir, ".change")
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't create temporary file at %s", queue.dir,
+		)
+	}
+	defer temporaryFile.Close()
+
+	_, err = temporaryFile.Write(data)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't write queued password change",
+		)
+	}
+
+	err = temporaryFile.Close()
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't close temporary file %s", temporaryFile.Name(),
+		)
+	}
+
+	err = os.Rename(temporaryFile.Name(), change.path)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't rename %s to %s", temporaryFile.Name(), change.path,
+		)
+	}
+
+	return nil
+}
+
+func (queue *PasswordChangeQueue) Remove(change *QueuedPasswordChange) error {
+	return os.Remove(change.path)
+}
+
+// List returns queued password changes in order they were queued.
+func (queue *PasswordChangeQueue) List() ([]*QueuedPasswordChange, error) {
+	paths, err := filepath.Glob(filepath.Join(queue.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+
+	changes := []*QueuedPasswordChange{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err, "can't read queued password change %s", path,
+			)
+		}
+
+		change := &QueuedPasswordChange{}
+
+		err = json.Unmarshal(data, change)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err, "can't decode queued password change %s", path,
+			)
+		}
+
+		change.path = path
+
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// ReadQueueKey reads key which encrypts queued password changes. Missing
+// key is generated if create is true.
+func ReadQueueKey(path string, create bool) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) != queueKeySize {
+			return nil, fmt.Errorf(
+				"%s is not valid queue key, %d bytes expected",
+				path, queueKeySize,
+			)
+		}
+
+		return key, nil
+	}
+
+	if !os.IsNotExist(err) || !create {
+		return nil, hierr.Errorf(err, "can't read queue key file %s", path)
+	}
+
+	key = make([]byte, queueKeySize)
+
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't generate queue key")
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err, "can't create directory %s", filepath.Dir(path),
+		)
+	}
+
+	file, err := os.OpenFile(
+		path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|unix.O_NOFOLLOW, 0600,
+	)
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't create queue key file %s", path)
+	}
+	defer file.Close()
+
+	_, err = file.Write(key)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		os.Remove(path)
+
+		return nil, hierr.Errorf(err, "can't write queue key file %s", path)
+	}
+
+	infof("queue key generated and written to %s", path)
+
+	return key, nil
+}
+
+type queuedPasswords struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+}
+
+func encryptPasswordChange(
+	key []byte, oldpassword, password string,
+) (string, error) {
+	plaintext, err := json.Marshal(queuedPasswords{
+		Password:    oldpassword,
+		NewPassword: password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newQueueCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", hierr.Errorf(
+			err, "can't generate nonce",
+		)
+	}
+
+	payload := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+func decryptPasswordChange(key []byte, payload string) (string, string, error) {
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", hierr.Errorf(err, "can't decode payload")
+	}
+
+	gcm, err := newQueueCipher(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", "", errors.New("payload is too short")
+	}
+
+	plaintext, err := gcm.Open(
+		nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil,
+	)
+	if err != nil {
+		return "", "", hierr.Errorf(
+			err, "can't decrypt payload, queue key has been changed",
+		)
+	}
+
+	var passwords queuedPasswords
+
+	err = json.Unmarshal(plaintext, &passwords)
+	if err != nil {
+		return "", "", hierr.Errorf(err, "can't decode payload")
+	}
+
+	return passwords.Password, passwords.NewPassword, nil
+}
+
+func newQueueCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func queuePasswordChange(
+	queue *PasswordChangeQueue, key []byte,
+	pool, username, oldpassword, password string,
+) error {
+	payload, err := encryptPasswordChange(key, oldpassword, password)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't encrypt password change",
+		)
+	}
+
+	return queue.Push(&QueuedPasswordChange{
+		Pool:      pool,
+		Username:  username,
+		CreatedAt: time.Now(),
+		Payload:   payload,
+	})
+}
+
+// submitQueuedPasswordChanges submits queued changes using the same protocol
+// as interactive password change. Changes rejected by shadowd servers, e.g.
+// because old password is wrong, and changes which can't be submitted for
+// too many times are dropped, so they are not retried forever.
+func submitQueuedPasswordChanges(
+	upstream *ShadowdUpstream, queue *PasswordChangeQueue, keyPath string,
+) error {
+	changes, err := queue.List()
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	key, err := ReadQueueKey(keyPath, false)
+	if err != nil {
+		return err
+	}
+
+	infof("submitting %d queued password changes", len(changes))
+
+	// changes for the same user should be submitted strictly in order,
+	// otherwise old password of the next change will not match.
+	failed := map[user]bool{}
+
+	for _, change := range changes {
+		if failed[user{change.Username, change.Pool}] {
+			continue
+		}
+
+		err := submitQueuedPasswordChange(upstream, change, key)
+		if err == nil {
+			infof(
+				"queued password change for %s submitted, "+
+					"hash table successfully generated",
+				user{change.Username, change.Pool},
+			)
+		} else {
+			change.Attempts++
+			change.LastAttemptAt = time.Now()
+			change.LastError = err.Error()
+
+			_, rejected := err.(RejectedError)
+			if !rejected && change.Attempts < queuedPasswordChangeMaxAttempts {
+				failed[user{change.Username, change.Pool}] = true
+
+				errorh(
+					err, "can't submit queued password change for %s",
+					user{change.Username, change.Pool},
+				)
+
+				err = queue.Save(change)
+				if err != nil {
+					return hierr.Errorf(
+						err, "can't update queued password change %s",
+						change.path,
+					)
+				}
+
+				continue
+			}
+
+			errorh(
+				err, "queued password change for %s is dropped after "+
+					"%d attempts",
+				user{change.Username, change.Pool}, change.Attempts,
+			)
+		}
+
+		err = queue.Remove(change)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't remove queued password change %s",
+				change.path,
+			)
+		}
+	}
+
+	return nil
+}
+
+// submitQueuedPasswordChange tries every alive shadowd server until one of
+// them accepts the change. Servers are never marked as gone away here,
+// because queue is submitted after the pull and its failures should not
+// affect other requests. RejectedError is returned as is, so the change is
+// not retried.
+func submitQueuedPasswordChange(
+	upstream *ShadowdUpstream, change *QueuedPasswordChange, key []byte,
+) error {
+	oldpassword, password, err := decryptPasswordChange(key, change.Payload)
+	if err != nil {
+		return RejectedError{err}
+	}
+
+	shadowdHosts, err := upstream.GetAliveShadowdHosts()
+	if err != nil {
+		return err
+	}
+
+	for _, shadowdHost := range shadowdHosts {
+		salts, err := shadowdHost.GetPasswordChangeSalts(
+			change.Pool, change.Username,
+		)
+		if err == nil {
+			err = shadowdHost.ChangePassword(
+				change.Pool, change.Username,
+				getProofShadows(oldpassword, salts), password,
+			)
+		}
+
+		switch err.(type) {
+		case nil:
+			return nil
+
+		case NotFoundError:
+			warningf(
+				"[%s] is not aware of %s",
+				shadowdHost.GetAddr(),
+				user{change.Username, change.Pool},
+			)
+
+		case RejectedError:
+			return hierr.Errorf(
+				err, "[%s] has rejected password change",
+				shadowdHost.GetAddr(),
+			)
+
+		default:
+			errorh(
+				err, "[%s] can't accept password change",
+				shadowdHost.GetAddr(),
+			)
+		}
+	}
+
+	return errors.New("no shadowd server accepted password change")
+}
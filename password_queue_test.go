@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordChangeEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.key")
+
+	_, err := ReadQueueKey(path, false)
+	if err == nil {
+		t.Fatal("missing key should not be created")
+	}
+
+	key, err := ReadQueueKey(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sameKey, err := ReadQueueKey(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(key, sameKey) {
+		t.Fatal("generated key should be reused")
+	}
+
+	payload, err := encryptPasswordChange(key, "old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldpassword, password, err := decryptPasswordChange(key, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if oldpassword != "old" || password != "new" {
+		t.Fatalf("unexpected passwords %q and %q", oldpassword, password)
+	}
+
+	anotherKey, err := ReadQueueKey(
+		filepath.Join(t.TempDir(), "queue.key"), true,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = decryptPasswordChange(anotherKey, payload)
+	if err == nil {
+		t.Fatal("payload should not be decrypted using another key")
+	}
+}
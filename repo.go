@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/reconquest/hierr-go"
 )
@@ -29,6 +30,12 @@ type NotFoundError struct {
 	error
 }
 
+// RejectedError is returned when shadowd server rejects the request with
+// client error status, so repeating the same request is pointless.
+type RejectedError struct {
+	error
+}
+
 func NewShadowdHost(
 	address string, resource *http.Client,
 ) (*ShadowdHost, error) {
@@ -96,17 +103,11 @@ func (shadowdHost *ShadowdHost) GetShadow(
 		)
 	}
 
-	if hash == proofHash {
-		warningf(
-			"[!] hash for %s was recently requested; "+
-				"possible break-in attempt.",
-			user{username, pool},
-		)
-	}
-
 	shadow := &Shadow{
-		Username: username,
-		Hash:     hash,
+		Username:   username,
+		Hash:       hash,
+		Server:     shadowdHost.GetAddr(),
+		IsRepeated: hash == proofHash,
 	}
 
 	return shadow, nil
@@ -131,10 +132,82 @@ func (shadowdHost *ShadowdHost) GetSSHKeys(
 		return nil, err
 	}
 
+	return readSSHKeys(body)
+}
+
+// GetSSHPrincipals returns SSH certificate principals which are allowed to
+// log in as specified user.
+func (shadowdHost *ShadowdHost) GetSSHPrincipals(
+	pool string, username string,
+) ([]string, error) {
+	var token string
+
+	if pool != "" {
+		token = pool + "/" + username
+	} else {
+		token = username
+	}
+
+	body, err := request(
+		shadowdHost.resource,
+		"GET", "https://"+shadowdHost.address+"/principals/"+token,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	principals := []string{}
+	for _, principal := range strings.Split(body, "\n") {
+		if isAuthorizedKeysComment(principal) {
+			continue
+		}
+
+		principals = append(principals, strings.TrimSpace(principal))
+	}
+
+	return principals, nil
+}
+
+// GetSSHCAKeys returns public keys of certificate authorities which are
+// trusted to sign certificates of users from specified pool.
+func (shadowdHost *ShadowdHost) GetSSHCAKeys(pool string) (SSHKeys, error) {
+	body, err := request(
+		shadowdHost.resource,
+		"GET", "https://"+shadowdHost.address+"/ca/"+pool,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return readSSHKeys(body)
+}
+
+// GetRevokedSSHKeys returns public keys which are revoked and should not be
+// accepted for any user of specified pool.
+func (shadowdHost *ShadowdHost) GetRevokedSSHKeys(
+	pool string,
+) (SSHKeys, error) {
+	body, err := request(
+		shadowdHost.resource,
+		"GET", "https://"+shadowdHost.address+"/revoked/"+pool,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return readSSHKeys(body)
+}
+
+// readSSHKeys parses keys listed one per line in authorized_keys format.
+func readSSHKeys(body string) (SSHKeys, error) {
 	sshKeys := SSHKeys{}
 
 	rawKeys := strings.Split(strings.TrimRight(body, "\n"), "\n")
 	for keyIndex, rawKey := range rawKeys {
+		if isAuthorizedKeysComment(rawKey) {
+			continue
+		}
+
 		key, err := ReadSSHKey(rawKey)
 		if err != nil {
 			return nil, hierr.Errorf(
@@ -291,6 +364,23 @@ func (upstream *ShadowdUpstream) GetAliveShadowdHosts() (
 	return hosts, nil
 }
 
+// SetTimeout sets time limit for requests to all shadowd servers.
+func (upstream *ShadowdUpstream) SetTimeout(timeout time.Duration) {
+	for _, host := range upstream.hosts {
+		host.resource.Timeout = timeout
+	}
+}
+
+func (upstream *ShadowdUpstream) HasAliveShadowdHosts() bool {
+	for _, host := range upstream.hosts {
+		if host.IsAlive() {
+			return true
+		}
+	}
+
+	return false
+}
+
 func readHTTPResponse(response *http.Response) (string, error) {
 	debugf("%s", response.Status)
 
@@ -306,6 +396,12 @@ func readHTTPResponse(response *http.Response) (string, error) {
 			}
 		}
 
+		if response.StatusCode >= 400 && response.StatusCode < 500 {
+			return "", RejectedError{
+				fmt.Errorf("request rejected: %s", response.Status),
+			}
+		}
+
 		return "", fmt.Errorf("unexpected status %s", response.Status)
 	}
 
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reconquest/hierr-go"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// exitCodeRunLocked is returned when another instance of shadowc holds
+	// the run lock, so schedulers can distinguish skipped runs from failures.
+	exitCodeRunLocked = 3
+
+	runLockRetryInterval = 100 * time.Millisecond
+)
+
+// RunLockedError is returned when run lock is held by another instance of
+// shadowc.
+type RunLockedError struct {
+	error
+}
+
+// RunLock prevents several instances of shadowc from changing the same files
+// simultaneously. Lock file contains pid and start time of the instance
+// which holds the lock, lock itself is released by kernel when process exits,
+// so lock file left after crash never blocks following runs.
+type RunLock struct {
+	file *os.File
+}
+
+// AcquireRunLock takes exclusive lock of specified file, waiting for the
+// specified time if the lock is held by another instance.
+func AcquireRunLock(path string, wait time.Duration) (*RunLock, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err, "can't create directory %s", filepath.Dir(path),
+		)
+	}
+
+	file, err := os.OpenFile(
+		path, os.O_RDWR|os.O_CREATE|unix.O_NOFOLLOW, 0644,
+	)
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't open run lock file %s", path)
+	}
+
+	deadline := time.Now().Add(wait)
+	waiting := false
+
+	for {
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			file.Close()
+			return nil, hierr.Errorf(err, "can't lock %s", path)
+		}
+
+		if time.Now().After(deadline) {
+			owner := describeRunLockOwner(file)
+			file.Close()
+
+			return nil, RunLockedError{
+				fmt.Errorf(
+					"another shadowc instance is running (%s), "+
+						"lock file %s",
+					owner, path,
+				),
+			}
+		}
+
+		if !waiting {
+			infof(
+				"waiting for another shadowc instance (%s) to finish",
+				describeRunLockOwner(file),
+			)
+
+			waiting = true
+		}
+
+		time.Sleep(runLockRetryInterval)
+	}
+
+	lock := &RunLock{file: file}
+
+	err = lock.writeOwner()
+	if err != nil {
+		lock.Release()
+		return nil, hierr.Errorf(
+			err, "can't write run lock file %s", path,
+		)
+	}
+
+	return lock, nil
+}
+
+func (lock *RunLock) writeOwner() error {
+	err := lock.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = lock.file.WriteAt(
+		[]byte(fmt.Sprintf(
+			"%d\n%s\n", os.Getpid(), time.Now().Format(time.RFC3339),
+		)),
+		0,
+	)
+	if err != nil {
+		return err
+	}
+
+	return lock.file.Sync()
+}
+
+// Release clears owner information and releases the lock.
+func (lock *RunLock) Release() error {
+	lock.file.Truncate(0)
+
+	return lock.file.Close()
+}
+
+// describeRunLockOwner returns human-readable description of the instance
+// which holds the lock, based on information recorded in lock file.
+func describeRunLockOwner(file *os.File) string {
+	_, err := file.Seek(0, 0)
+	if err != nil {
+		return "unknown pid"
+	}
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "unknown pid"
+	}
+
+	fields := strings.Fields(string(contents))
+	if len(fields) == 0 {
+		return "unknown pid"
+	}
+
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "unknown pid"
+	}
+
+	description := fmt.Sprintf("pid %d", pid)
+	if len(fields) > 1 {
+		description += " started at " + fields[1]
+	}
+
+	// lock is held, but recorded process is gone: descriptor of the lock
+	// file has been inherited by a process which is still running.
+	if unix.Kill(pid, 0) == unix.ESRCH {
+		description += ", which is not running anymore, " +
+			"lock is held by its child process"
+	}
+
+	return description
+}
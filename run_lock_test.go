@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireRunLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "shadowc.lock")
+
+	lock, err := AcquireRunLock(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := fmt.Sprintf("%d\n", os.Getpid())
+	if !strings.HasPrefix(string(contents), owner) {
+		t.Fatalf("lock file should contain pid of owner: %q", contents)
+	}
+
+	started := time.Now()
+
+	_, err = AcquireRunLock(path, 300*time.Millisecond)
+	if _, ok := err.(RunLockedError); !ok {
+		t.Fatalf("held lock should be reported as RunLockedError: %v", err)
+	}
+
+	if time.Since(started) < 300*time.Millisecond {
+		t.Fatal("lock should be waited for the specified time")
+	}
+
+	if !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Fatalf("error should describe lock owner: %v", err)
+	}
+
+	err = lock.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err = AcquireRunLock(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Release()
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reconquest/hierr-go"
+
+	"golang.org/x/sys/unix"
+)
+
+const maxSymlinksFollowed = 40
+
+// SecureDirectory is a directory opened without following symlinks planted
+// by users. All operations are performed relative to the directory
+// descriptor, so directory can't be replaced while shadowc works with it,
+// which matters because shadowc runs as root and writes into directories
+// controlled by users.
+type SecureDirectory struct {
+	fd   int
+	path string
+	uid  int
+	gid  int
+}
+
+// OpenSecureDirectory opens directory at specified absolute path, walking
+// through each path component without following symlinks. Every component
+// should be owned either by root or by specified uid, otherwise error is
+// returned. Symlinks are followed only if both symlink and directory
+// containing it are owned by root, so users can't plant them.
+//
+// Missing components are created with specified mode and owned by specified
+// uid and gid.
+func OpenSecureDirectory(
+	path string, uid, gid int, mode os.FileMode,
+) (*SecureDirectory, error) {
+	return openSecureDirectory(path, uid, gid, mode, true)
+}
+
+// OpenExistingSecureDirectory opens directory the same way as
+// OpenSecureDirectory does, but never creates missing components; error
+// satisfying os.IsNotExist is returned instead.
+func OpenExistingSecureDirectory(
+	path string, uid, gid int,
+) (*SecureDirectory, error) {
+	return openSecureDirectory(path, uid, gid, 0, false)
+}
+
+func openSecureDirectory(
+	path string, uid, gid int, mode os.FileMode, create bool,
+) (*SecureDirectory, error) {
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("path %s is not absolute", path)
+	}
+
+	fd, err := unix.Open(
+		"/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0,
+	)
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't open /")
+	}
+
+	directory := &SecureDirectory{
+		fd:   fd,
+		path: "/",
+		uid:  uid,
+		gid:  gid,
+	}
+
+	err = directory.verifyOwner()
+	if err != nil {
+		directory.Close()
+		return nil, err
+	}
+
+	components := splitPath(path)
+	symlinks := 0
+
+	for len(components) > 0 {
+		name := components[0]
+		components = components[1:]
+
+		target, err := directory.readRootSymlink(name)
+		if err != nil {
+			directory.Close()
+			return nil, err
+		}
+
+		if target != "" {
+			symlinks++
+			if symlinks > maxSymlinksFollowed {
+				directory.Close()
+				return nil, fmt.Errorf(
+					"too many symlinks while resolving %s", path,
+				)
+			}
+
+			if filepath.IsAbs(target) {
+				directory.Close()
+
+				return openSecureDirectory(
+					filepath.Join(
+						append([]string{target}, components...)...,
+					),
+					uid, gid, mode, create,
+				)
+			}
+
+			components = append(splitPath(target), components...)
+			continue
+		}
+
+		child, err := directory.openDirectory(name, mode, create)
+		directory.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		directory = child
+	}
+
+	return directory, nil
+}
+
+// OpenDirectory opens or creates subdirectory without following symlinks
+// and verifies its owner.
+func (directory *SecureDirectory) OpenDirectory(
+	name string, mode os.FileMode,
+) (*SecureDirectory, error) {
+	return directory.openDirectory(name, mode, true)
+}
+
+func (directory *SecureDirectory) openDirectory(
+	name string, mode os.FileMode, create bool,
+) (*SecureDirectory, error) {
+	path := filepath.Join(directory.path, name)
+
+	fd, err := unix.Openat(
+		directory.fd, name,
+		unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0,
+	)
+	if err == unix.ENOENT && !create {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	if err == unix.ENOENT {
+		err = unix.Mkdirat(directory.fd, name, uint32(mode.Perm()))
+		if err != nil && err != unix.EEXIST {
+			return nil, hierr.Errorf(
+				err, "can't create directory %s", path,
+			)
+		}
+
+		fd, err = unix.Openat(
+			directory.fd, name,
+			unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0,
+		)
+		if err == nil {
+			err = unix.Fchown(fd, directory.uid, directory.gid)
+			if err != nil {
+				unix.Close(fd)
+				return nil, hierr.Errorf(
+					err, "can't change directory %s owner", path,
+				)
+			}
+		}
+	}
+	if err != nil {
+		if err == unix.ELOOP || err == unix.ENOTDIR {
+			return nil, fmt.Errorf(
+				"%s is not a directory or is a symlink, "+
+					"refusing to operate on it",
+				path,
+			)
+		}
+
+		return nil, hierr.Errorf(err, "can't open directory %s", path)
+	}
+
+	child := &SecureDirectory{
+		fd:   fd,
+		path: path,
+		uid:  directory.uid,
+		gid:  directory.gid,
+	}
+
+	err = child.verifyOwner()
+	if err != nil {
+		child.Close()
+		return nil, err
+	}
+
+	return child, nil
+}
+
+// readRootSymlink returns target of the symlink with specified name if both
+// symlink and directory are owned by root, or empty string if name is not a
+// symlink.
+func (directory *SecureDirectory) readRootSymlink(name string) (string, error) {
+	var stat unix.Stat_t
+
+	err := unix.Fstatat(
+		directory.fd, name, &stat, unix.AT_SYMLINK_NOFOLLOW,
+	)
+	if err != nil {
+		if err == unix.ENOENT {
+			return "", nil
+		}
+
+		return "", hierr.Errorf(
+			err, "can't stat %s", filepath.Join(directory.path, name),
+		)
+	}
+
+	if stat.Mode&unix.S_IFMT != unix.S_IFLNK {
+		return "", nil
+	}
+
+	var directoryStat unix.Stat_t
+
+	err = unix.Fstat(directory.fd, &directoryStat)
+	if err != nil {
+		return "", hierr.Errorf(err, "can't stat %s", directory.path)
+	}
+
+	if stat.Uid != 0 || directoryStat.Uid != 0 {
+		return "", fmt.Errorf(
+			"%s is a symlink not owned by root, refusing to follow it",
+			filepath.Join(directory.path, name),
+		)
+	}
+
+	buffer := make([]byte, unix.PathMax)
+
+	length, err := unix.Readlinkat(directory.fd, name, buffer)
+	if err != nil {
+		return "", hierr.Errorf(
+			err, "can't read symlink %s",
+			filepath.Join(directory.path, name),
+		)
+	}
+
+	return string(buffer[:length]), nil
+}
+
+func (directory *SecureDirectory) verifyOwner() error {
+	var stat unix.Stat_t
+
+	err := unix.Fstat(directory.fd, &stat)
+	if err != nil {
+		return hierr.Errorf(err, "can't stat %s", directory.path)
+	}
+
+	if stat.Uid != 0 && int(stat.Uid) != directory.uid {
+		return fmt.Errorf(
+			"%s is owned by another user (uid %d), "+
+				"refusing to operate on it",
+			directory.path, stat.Uid,
+		)
+	}
+
+	return nil
+}
+
+// OpenFile opens regular file for reading without following symlinks, file
+// should be owned either by root or by directory user, like sshd requires,
+// and should not have other hard links, otherwise user could plant a link to
+// a file which is not writable by them, like /etc/shadow, and get it
+// overwritten or copied.
+func (directory *SecureDirectory) OpenFile(name string) (*os.File, error) {
+	path := filepath.Join(directory.path, name)
+
+	fd, err := unix.Openat(
+		directory.fd, name,
+		unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0,
+	)
+	if err != nil {
+		if err == unix.ELOOP {
+			return nil, fmt.Errorf(
+				"%s is a symlink, refusing to operate on it", path,
+			)
+		}
+
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	var stat unix.Stat_t
+
+	err = unix.Fstat(fd, &stat)
+	if err != nil {
+		unix.Close(fd)
+		return nil, hierr.Errorf(err, "can't stat %s", path)
+	}
+
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		unix.Close(fd)
+		return nil, fmt.Errorf(
+			"%s is not a regular file, refusing to operate on it", path,
+		)
+	}
+
+	if stat.Uid != 0 && int(stat.Uid) != directory.uid {
+		unix.Close(fd)
+		return nil, fmt.Errorf(
+			"%s is owned by another user (uid %d), "+
+				"refusing to operate on it",
+			path, stat.Uid,
+		)
+	}
+
+	if stat.Nlink > 1 {
+		unix.Close(fd)
+		return nil, fmt.Errorf(
+			"%s has %d hard links, refusing to operate on it",
+			path, stat.Nlink,
+		)
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// CreateTempFile creates new file with random name, which is owned by
+// directory user and has specified mode.
+func (directory *SecureDirectory) CreateTempFile(
+	prefix string, mode os.FileMode,
+) (*os.File, error) {
+	random := make([]byte, 8)
+
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+
+	name := "." + prefix + "." + hex.EncodeToString(random)
+	path := filepath.Join(directory.path, name)
+
+	fd, err := unix.Openat(
+		directory.fd, name,
+		unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC,
+		0600,
+	)
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't create file %s", path)
+	}
+
+	err = unix.Fchown(fd, directory.uid, directory.gid)
+	if err == nil {
+		err = unix.Fchmod(fd, uint32(mode.Perm()))
+	}
+	if err != nil {
+		unix.Close(fd)
+		unix.Unlinkat(directory.fd, name, 0)
+
+		return nil, hierr.Errorf(
+			err, "can't change file %s owner and mode", path,
+		)
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Rename atomically replaces file newname with file oldname, both names are
+// relative to the directory.
+func (directory *SecureDirectory) Rename(oldname, newname string) error {
+	return unix.Renameat(directory.fd, oldname, directory.fd, newname)
+}
+
+// Remove removes file with specified name from the directory.
+func (directory *SecureDirectory) Remove(name string) error {
+	return unix.Unlinkat(directory.fd, name, 0)
+}
+
+// Sync flushes directory entries, so renames performed in directory survive
+// crash.
+func (directory *SecureDirectory) Sync() error {
+	return unix.Fsync(directory.fd)
+}
+
+// Stat returns information about the directory itself.
+func (directory *SecureDirectory) Stat() (unix.Stat_t, error) {
+	var stat unix.Stat_t
+
+	err := unix.Fstat(directory.fd, &stat)
+	if err != nil {
+		return stat, hierr.Errorf(err, "can't stat %s", directory.path)
+	}
+
+	return stat, nil
+}
+
+// Chmod changes mode of the directory itself, including setuid, setgid and
+// sticky bits.
+func (directory *SecureDirectory) Chmod(mode os.FileMode) error {
+	return unix.Fchmod(directory.fd, getUnixModeBits(mode))
+}
+
+// GetOwner returns uid and gid of the user which directory is opened for.
+func (directory *SecureDirectory) GetOwner() (int, int) {
+	return directory.uid, directory.gid
+}
+
+func (directory *SecureDirectory) GetPath() string {
+	return directory.path
+}
+
+func (directory *SecureDirectory) Close() error {
+	return unix.Close(directory.fd)
+}
+
+// fileModeBits are bits of os.FileMode which can be changed by chmod.
+const fileModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid |
+	os.ModeSticky
+
+// getUnixFileMode converts mode bits returned by stat to os.FileMode,
+// file type is not converted.
+func getUnixFileMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode) & os.ModePerm
+
+	if mode&unix.S_ISUID != 0 {
+		fileMode |= os.ModeSetuid
+	}
+
+	if mode&unix.S_ISGID != 0 {
+		fileMode |= os.ModeSetgid
+	}
+
+	if mode&unix.S_ISVTX != 0 {
+		fileMode |= os.ModeSticky
+	}
+
+	return fileMode
+}
+
+// getUnixModeBits converts os.FileMode to mode bits accepted by chmod.
+func getUnixModeBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+
+	if mode&os.ModeSetuid != 0 {
+		bits |= unix.S_ISUID
+	}
+
+	if mode&os.ModeSetgid != 0 {
+		bits |= unix.S_ISGID
+	}
+
+	if mode&os.ModeSticky != 0 {
+		bits |= unix.S_ISVTX
+	}
+
+	return bits
+}
+
+func splitPath(path string) []string {
+	components := []string{}
+	for _, component := range strings.Split(path, "/") {
+		if component != "" && component != "." {
+			components = append(components, component)
+		}
+	}
+
+	return components
+}
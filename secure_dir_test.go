@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecureDirectoryOpenFile(t *testing.T) {
+	root := t.TempDir()
+
+	err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("x"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Link(filepath.Join(root, "file"), filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(root, "single"), []byte("x"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Symlink("single", filepath.Join(root, "symlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+
+	dir, err := OpenSecureDirectory(root, uid, gid, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	file, err := dir.OpenFile("single")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	for _, name := range []string{"file", "link", "symlink"} {
+		file, err := dir.OpenFile(name)
+		if err == nil {
+			file.Close()
+			t.Fatalf("%s should not be opened", name)
+		}
+	}
+
+	_, err = dir.OpenFile("missing")
+	if !os.IsNotExist(err) {
+		t.Fatalf("missing file should be reported as not existing: %v", err)
+	}
+}
+
+func TestSecureDirectoryOpenFileOwnedByAnotherUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing file owner requires root")
+	}
+
+	root := t.TempDir()
+
+	for _, name := range []string{"root", "another"} {
+		err := ioutil.WriteFile(filepath.Join(root, name), []byte("x"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := os.Chown(filepath.Join(root, "another"), 65533, 65533)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// directory is owned by root, which is allowed for user directories.
+	dir, err := OpenSecureDirectory(root, 65534, 65534, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	// sshd accepts authorized_keys owned by root as well.
+	file, err := dir.OpenFile("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	file, err = dir.OpenFile("another")
+	if err == nil {
+		file.Close()
+		t.Fatal("file owned by another user should not be opened")
+	}
+}
+
+func TestOpenExistingSecureDirectory(t *testing.T) {
+	root := t.TempDir()
+
+	path := filepath.Join(root, "home", ".ssh")
+
+	_, err := OpenExistingSecureDirectory(path, os.Getuid(), os.Getgid())
+	if !os.IsNotExist(err) {
+		t.Fatalf("missing directory should be reported: %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(root, "home"))
+	if !os.IsNotExist(err) {
+		t.Fatal("missing directory should not be created")
+	}
+
+	dir, err := OpenSecureDirectory(path, os.Getuid(), os.Getgid(), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir.Close()
+
+	dir, err = OpenExistingSecureDirectory(path, os.Getuid(), os.Getgid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir.Close()
+}
@@ -8,6 +8,13 @@ type (
 	Shadow struct {
 		Username string
 		Hash     string
+
+		// Server is address of shadowd server which has provided the hash.
+		Server string
+
+		// IsRepeated is true if the same hash has been returned twice in a
+		// row within one request.
+		IsRepeated bool
 	}
 
 	Shadows []*Shadow
@@ -1,15 +1,51 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/reconquest/hierr-go"
 )
 
+// shadowEntryFields is amount of colon-separated fields in shadow entry.
+const shadowEntryFields = 9
+
+// ShadowEntry is a single entry of shadow file. Numeric fields are kept as
+// strings, because all of them can be empty and should be written back
+// exactly as they were read.
+type ShadowEntry struct {
+	Username         string
+	Hash             string
+	LastChanged      string
+	MinAge           string
+	MaxAge           string
+	WarningPeriod    string
+	InactivityPeriod string
+	ExpirationDate   string
+	Reserved         string
+}
+
+// ShadowFileLine is a single line of shadow file. Entry is nil for blank
+// lines, comments, NIS compat lines (started with + or -) and malformed
+// lines, such lines are written back verbatim. Error is set for malformed
+// lines.
+type ShadowFileLine struct {
+	Number int
+	Raw    string
+	Entry  *ShadowEntry
+	Error  error
+}
+
+// ShadowFile is a parsed shadow file with entries indexed by user name.
 type ShadowFile struct {
 	path  string
-	lines []string
+	lines []*ShadowFileLine
+	index map[string]*ShadowFileLine
 }
 
 func ReadShadowFile(path string) (*ShadowFile, error) {
@@ -18,42 +54,283 @@ func ReadShadowFile(path string) (*ShadowFile, error) {
 		return nil, err
 	}
 
-	lines := strings.Split(
-		strings.TrimRight(string(shadowEntries), "\n"),
-		"\n",
-	)
+	return ParseShadowFile(string(shadowEntries), path), nil
+}
 
-	return &ShadowFile{
+// ParseShadowFile parses contents of shadow file, path is used only for
+// reporting. Malformed lines are preserved as is and reported by Validate.
+func ParseShadowFile(contents string, path string) *ShadowFile {
+	file := &ShadowFile{
 		path:  path,
-		lines: lines,
+		index: map[string]*ShadowFileLine{},
+	}
+
+	contents = strings.TrimRight(contents, "\n")
+	if contents == "" {
+		return file
+	}
+
+	for number, raw := range strings.Split(contents, "\n") {
+		line := &ShadowFileLine{
+			Number: number + 1,
+			Raw:    raw,
+		}
+
+		if !isShadowFileComment(raw) {
+			line.Entry, line.Error = ParseShadowEntry(raw)
+		}
+
+		file.lines = append(file.lines, line)
+
+		if line.Entry == nil {
+			continue
+		}
+
+		if _, ok := file.index[line.Entry.Username]; ok {
+			line.Error = fmt.Errorf(
+				"duplicate entry for user %s", line.Entry.Username,
+			)
+			line.Entry = nil
+
+			continue
+		}
+
+		file.index[line.Entry.Username] = line
+	}
+
+	return file
+}
+
+// isShadowFileComment reports whether line is not an entry of local user:
+// blank line, comment or NIS compat line.
+func isShadowFileComment(line string) bool {
+	return strings.TrimSpace(line) == "" ||
+		strings.HasPrefix(line, "#") ||
+		strings.HasPrefix(line, "+") ||
+		strings.HasPrefix(line, "-")
+}
+
+// ParseShadowEntry parses single shadow entry in format:
+// name:hash:lastchg:min:max:warn:inactive:expire:reserved.
+func ParseShadowEntry(line string) (*ShadowEntry, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) != shadowEntryFields {
+		return nil, fmt.Errorf(
+			"expected %d fields, found %d", shadowEntryFields, len(fields),
+		)
+	}
+
+	if fields[0] == "" {
+		return nil, errors.New("empty user name")
+	}
+
+	names := []string{
+		"last password change", "minimum password age",
+		"maximum password age", "password warning period",
+		"password inactivity period", "account expiration date",
+	}
+
+	for index, name := range names {
+		value := fields[index+2]
+		if value == "" {
+			continue
+		}
+
+		_, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", name, value)
+		}
+	}
+
+	return &ShadowEntry{
+		Username:         fields[0],
+		Hash:             fields[1],
+		LastChanged:      fields[2],
+		MinAge:           fields[3],
+		MaxAge:           fields[4],
+		WarningPeriod:    fields[5],
+		InactivityPeriod: fields[6],
+		ExpirationDate:   fields[7],
+		Reserved:         fields[8],
 	}, nil
 }
 
+func (entry *ShadowEntry) String() string {
+	return strings.Join([]string{
+		entry.Username,
+		entry.Hash,
+		entry.LastChanged,
+		entry.MinAge,
+		entry.MaxAge,
+		entry.WarningPeriod,
+		entry.InactivityPeriod,
+		entry.ExpirationDate,
+		entry.Reserved,
+	}, ":")
+}
+
+// HasPassword reports whether entry has password hash, not a locked or
+// empty password.
+func (entry *ShadowEntry) HasPassword() bool {
+	return len(entry.Hash) > 1 && entry.Hash[0] == '$'
+}
+
+// Validate returns error which lists all malformed lines of the file along
+// with their numbers.
+func (file *ShadowFile) Validate() error {
+	messages := []string{}
+	for _, line := range file.lines {
+		if line.Error != nil {
+			messages = append(
+				messages,
+				fmt.Sprintf("line #%d: %s", line.Number, line.Error),
+			)
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return hierr.Errorf(
+		errors.New(strings.Join(messages, "\n")),
+		"shadow file %s contains malformed lines", file.path,
+	)
+}
+
+// GetEntry returns entry of specified user or nil if there is no such entry.
+func (file *ShadowFile) GetEntry(userName string) *ShadowEntry {
+	line, ok := file.index[userName]
+	if !ok {
+		return nil
+	}
+
+	return line.Entry
+}
+
+// GetEntries returns all valid entries of the file in order of appearance.
+func (file *ShadowFile) GetEntries() []*ShadowEntry {
+	entries := []*ShadowEntry{}
+	for _, line := range file.lines {
+		if line.Entry != nil {
+			entries = append(entries, line.Entry)
+		}
+	}
+
+	return entries
+}
+
+func (file *ShadowFile) HasUser(userName string) bool {
+	return file.GetEntry(userName) != nil
+}
+
+// validateShadowHash returns error if hash contains separators of shadow
+// file, such hash would break the entry or produce extra ones.
+func validateShadowHash(hash string) error {
+	if strings.ContainsAny(hash, ":\n") {
+		return fmt.Errorf("hash %q contains ':' or line break", hash)
+	}
+
+	return nil
+}
+
+// SetShadow replaces password hash of the user, other fields of the entry
+// are left untouched.
 func (file *ShadowFile) SetShadow(shadow *Shadow) error {
-	index, err := file.GetUserIndex(shadow.Username)
+	entry := file.GetEntry(shadow.Username)
+	if entry == nil {
+		return fmt.Errorf(
+			"user %s is not found in shadow file %s",
+			shadow.Username, file.path,
+		)
+	}
+
+	err := validateShadowHash(shadow.Hash)
 	if err != nil {
 		return err
 	}
 
-	file.lines[index] = fmt.Sprintf("%s", shadow)
+	entry.Hash = shadow.Hash
 
 	return nil
 }
 
-func (file *ShadowFile) GetUserIndex(userName string) (int, error) {
-	for index, line := range file.lines {
-		if strings.HasPrefix(line, userName+":") {
-			return index, nil
+// AddShadow appends new entry for the user with specified password hash,
+// password is marked as changed today and aging fields are filled with
+// common defaults.
+func (file *ShadowFile) AddShadow(shadow *Shadow) error {
+	if file.HasUser(shadow.Username) {
+		return fmt.Errorf(
+			"user %s already exists in shadow file %s",
+			shadow.Username, file.path,
+		)
+	}
+
+	err := validateShadowHash(shadow.Hash)
+	if err != nil {
+		return err
+	}
+
+	prefix := shadow.Username + ":"
+	for _, line := range file.lines {
+		if line.Error != nil && strings.HasPrefix(line.Raw, prefix) {
+			return fmt.Errorf(
+				"user %s has malformed entry at line #%d of shadow file %s",
+				shadow.Username, line.Number, file.path,
+			)
 		}
 	}
 
-	return 0, fmt.Errorf(
-		"user %s is not found in shadow file %s", userName, file.path,
-	)
+	entry := &ShadowEntry{
+		Username:      shadow.Username,
+		Hash:          shadow.Hash,
+		LastChanged:   strconv.FormatInt(time.Now().Unix()/86400, 10),
+		MinAge:        "0",
+		MaxAge:        "99999",
+		WarningPeriod: "7",
+	}
+
+	line := &ShadowFileLine{
+		Number: len(file.lines) + 1,
+		Raw:    entry.String(),
+		Entry:  entry,
+	}
+
+	file.lines = append(file.lines, line)
+	file.index[entry.Username] = line
+
+	return nil
+}
+
+func (file *ShadowFile) GetHash(userName string) (string, error) {
+	entry := file.GetEntry(userName)
+	if entry == nil {
+		return "", fmt.Errorf(
+			"user %s is not found in shadow file %s", userName, file.path,
+		)
+	}
+
+	return entry.Hash, nil
 }
 
 func (file *ShadowFile) Write(writer io.Writer) (int, error) {
-	return io.WriteString(writer, strings.Join(file.lines, "\n")+"\n")
+	totalWritten := 0
+
+	for _, line := range file.lines {
+		raw := line.Raw
+		if line.Entry != nil {
+			raw = line.Entry.String()
+		}
+
+		written, err := io.WriteString(writer, raw+"\n")
+		if err != nil {
+			return totalWritten, err
+		}
+
+		totalWritten += written
+	}
+
+	return totalWritten, nil
 }
 
 func (file *ShadowFile) GetPath() string {
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseShadowEntry(t *testing.T) {
+	testcases := []struct {
+		line  string
+		valid bool
+	}{
+		{"root:$6$salt$hash:19000:0:99999:7:::", true},
+		{"john:!:19000::::::", true},
+		{"john:*:::::::", true},
+		{"john:!:19000:0:99999:7::", false},
+		{"john:!:19000:0:99999:7::::", false},
+		{":!:19000:0:99999:7:::", false},
+		{"john:!:yesterday:0:99999:7:::", false},
+		{"john:!:19000:0:99999:7::never:", false},
+	}
+
+	for _, testcase := range testcases {
+		entry, err := ParseShadowEntry(testcase.line)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%q: error expected", testcase.line)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", testcase.line, err)
+			continue
+		}
+
+		if entry.String() != testcase.line {
+			t.Errorf(
+				"%q: entry is changed after round-trip: %q",
+				testcase.line, entry.String(),
+			)
+		}
+	}
+}
+
+func TestParseShadowFile(t *testing.T) {
+	testcases := []struct {
+		name      string
+		contents  string
+		entries   int
+		malformed int
+	}{
+		{
+			name:     "empty",
+			contents: "",
+		},
+		{
+			name: "entries, comments and NIS lines",
+			contents: "# comment\n" +
+				"root:$6$salt$hash:19000:0:99999:7:::\n" +
+				"\n" +
+				"+@admins::::::::\n" +
+				"-bob::::::::\n" +
+				"john:!:19000:0:99999:7:::\n",
+			entries: 2,
+		},
+		{
+			name: "malformed and duplicate lines",
+			contents: "root:$6$salt$hash:19000:0:99999:7:::\n" +
+				"broken:!:19000\n" +
+				"root:!:19000:0:99999:7:::\n",
+			entries:   1,
+			malformed: 2,
+		},
+	}
+
+	for _, testcase := range testcases {
+		shadowFile := ParseShadowFile(testcase.contents, "shadow")
+
+		if len(shadowFile.GetEntries()) != testcase.entries {
+			t.Errorf(
+				"%s: expected %d entries, got %d",
+				testcase.name, testcase.entries,
+				len(shadowFile.GetEntries()),
+			)
+		}
+
+		malformed := 0
+		for _, line := range shadowFile.lines {
+			if line.Error != nil {
+				malformed++
+			}
+		}
+
+		if malformed != testcase.malformed {
+			t.Errorf(
+				"%s: expected %d malformed lines, got %d",
+				testcase.name, testcase.malformed, malformed,
+			)
+		}
+
+		if (shadowFile.Validate() == nil) != (testcase.malformed == 0) {
+			t.Errorf(
+				"%s: unexpected validation result: %v",
+				testcase.name, shadowFile.Validate(),
+			)
+		}
+
+		buffer := &bytes.Buffer{}
+
+		_, err := shadowFile.Write(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if buffer.String() != testcase.contents {
+			t.Errorf(
+				"%s: contents are changed after round-trip: %q",
+				testcase.name, buffer.String(),
+			)
+		}
+	}
+}
+
+func TestShadowFileSetAndAddShadow(t *testing.T) {
+	shadowFile := ParseShadowFile(
+		"root:!:19000:0:99999:7:::\n"+
+			"broken:!:19000\n",
+		"shadow",
+	)
+
+	err := shadowFile.SetShadow(&Shadow{Username: "root", Hash: "$6$new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = shadowFile.SetShadow(&Shadow{Username: "john", Hash: "$6$new"})
+	if err == nil {
+		t.Fatal("missing user should not be updated")
+	}
+
+	err = shadowFile.AddShadow(&Shadow{Username: "john", Hash: "$6$john"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = shadowFile.AddShadow(&Shadow{Username: "broken", Hash: "$6$x"})
+	if err == nil {
+		t.Fatal("user with malformed entry should not get another one")
+	}
+
+	err = shadowFile.AddShadow(&Shadow{Username: "root", Hash: "$6$x"})
+	if err == nil {
+		t.Fatal("existing user should not be added")
+	}
+
+	hash, err := shadowFile.GetHash("root")
+	if err != nil || hash != "$6$new" {
+		t.Fatalf("unexpected hash of root: %q, %v", hash, err)
+	}
+
+	buffer := &bytes.Buffer{}
+
+	_, err = shadowFile.Write(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reparsed := ParseShadowFile(buffer.String(), "shadow")
+	if len(reparsed.GetEntries()) != 2 || reparsed.GetEntry("john") == nil {
+		t.Fatalf("unexpected contents after writing: %q", buffer.String())
+	}
+
+	if reparsed.GetEntry("john").Hash != "$6$john" {
+		t.Fatal("added entry should keep hash")
+	}
+}
+
+func TestGetUsersWithPasswordsSkipsMalformedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shadow")
+
+	writeTestFile(
+		t, path,
+		"root:$6$salt$hash:19000:0:99999:7:::\n"+
+			"broken:$6$salt$hash:19000\n"+
+			"daemon:*:19000:0:99999:7:::\n",
+	)
+
+	usernames, err := getUsersWithPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(usernames) != 1 || usernames[0] != "root" {
+		t.Fatalf("unexpected users %q", usernames)
+	}
+}
+
+func TestWriteShadowsSkipsInvalidHashes(t *testing.T) {
+	root := t.TempDir()
+
+	shadowPath := filepath.Join(root, "shadow")
+	writeTestFile(
+		t, shadowPath,
+		"root:!:19000:0:99999:7:::\njohn:!:19000:0:99999:7:::\n",
+	)
+
+	shadowFile, err := ReadShadowFile(shadowPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction, err := NewTransaction(
+		filepath.Join(root, "state"), time.Second, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failedUsers, err := writeShadows(
+		&Shadows{
+			{Username: "root", Hash: "$6$root:0:0:::::\nevil:$6$x"},
+			{Username: "john", Hash: "$6$john"},
+			{Username: "alice", Hash: "$6$alice\n"},
+		},
+		shadowFile, map[string]bool{"alice": true}, transaction,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(failedUsers, ",") != "root,alice" {
+		t.Fatalf("users with invalid hashes should fail: %q", failedUsers)
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "root:!:19000:0:99999:7:::\njohn:$6$john:19000:0:99999:7:::\n"
+	if readTestFile(t, shadowPath) != expected {
+		t.Fatalf("unexpected shadow file %q", readTestFile(t, shadowPath))
+	}
+}
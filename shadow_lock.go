@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/reconquest/hierr-go"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	shadowLockFileName = ".pwd.lock"
+
+	shadowLockRetryInterval = 100 * time.Millisecond
+)
+
+// ShadowLock is an exclusive lock of passwd and shadow files, which is
+// compatible with lckpwdf(3) used by shadow-utils: write lock is taken on
+// the whole .pwd.lock file located in the same directory as shadow file.
+type ShadowLock struct {
+	file *os.File
+}
+
+// LockShadowFile acquires lock for modifying specified shadow file and waits
+// for specified time if lock is held by another process.
+func LockShadowFile(
+	shadowPath string, timeout time.Duration,
+) (*ShadowLock, error) {
+	path := filepath.Join(filepath.Dir(shadowPath), shadowLockFileName)
+
+	file, err := os.OpenFile(
+		path, os.O_WRONLY|os.O_CREATE|unix.O_NOFOLLOW, 0600,
+	)
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't open lock file %s", path)
+	}
+
+	lock := unix.Flock_t{
+		Type:   unix.F_WRLCK,
+		Whence: 0,
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err = unix.FcntlFlock(file.Fd(), unix.F_SETLK, &lock)
+		if err == nil {
+			return &ShadowLock{file: file}, nil
+		}
+
+		if err != unix.EAGAIN && err != unix.EACCES && err != unix.EINTR {
+			file.Close()
+			return nil, hierr.Errorf(err, "can't lock %s", path)
+		}
+
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf(
+				"can't lock %s: lock is held by another process for %s",
+				path, timeout,
+			)
+		}
+
+		time.Sleep(shadowLockRetryInterval)
+	}
+}
+
+// Unlock releases the lock, lock is released automatically on process exit
+// as well.
+func (lock *ShadowLock) Unlock() error {
+	return lock.file.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testShadowLockHelperEnv = "SHADOWC_TEST_SHADOW_LOCK"
+
+// TestShadowLockHelperProcess holds shadow lock in separate process until
+// its stdin is closed, because fcntl(2) locks don't conflict within the same
+// process.
+func TestShadowLockHelperProcess(t *testing.T) {
+	shadowPath := os.Getenv(testShadowLockHelperEnv)
+	if shadowPath == "" {
+		t.Skip("helper process")
+	}
+
+	lock, err := LockShadowFile(shadowPath, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Stdout.WriteString("locked\n")
+
+	bufio.NewReader(os.Stdin).ReadString('\n')
+
+	lock.Unlock()
+}
+
+func TestLockShadowFile(t *testing.T) {
+	shadowPath := filepath.Join(t.TempDir(), "shadow")
+
+	helper := exec.Command(
+		os.Args[0], "-test.run=^TestShadowLockHelperProcess$",
+	)
+	helper.Env = append(
+		os.Environ(), testShadowLockHelperEnv+"="+shadowPath,
+	)
+
+	stdin, err := helper.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, err := helper.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = helper.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Wait()
+	defer stdin.Close()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		t.Fatalf("helper process can't take the lock: %q %v", line, err)
+	}
+
+	started := time.Now()
+
+	_, err = LockShadowFile(shadowPath, 300*time.Millisecond)
+	if err == nil {
+		t.Fatal("lock held by another process should not be taken")
+	}
+
+	if time.Since(started) < 300*time.Millisecond {
+		t.Fatal("lock should be waited for the specified timeout")
+	}
+
+	stdin.Close()
+
+	lock, err := LockShadowFile(shadowPath, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(
+		filepath.Join(filepath.Dir(shadowPath), shadowLockFileName),
+	)
+	if err != nil {
+		t.Fatalf("lock file should be created next to shadow file: %v", err)
+	}
+}
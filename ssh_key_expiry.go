@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const sshKeyExpiryOption = "expiry-time"
+
+// GetExpiryTime returns time specified in 'expiry-time' option of the key
+// and reports whether key has such option at all.
+func (key *SSHKey) GetExpiryTime() (time.Time, bool, error) {
+	for _, option := range key.Options {
+		if !strings.EqualFold(
+			getSSHKeyOptionName(option), sshKeyExpiryOption,
+		) {
+			continue
+		}
+
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return time.Time{}, true, fmt.Errorf(
+				"option %s has no value", sshKeyExpiryOption,
+			)
+		}
+
+		expiryTime, err := parseSSHKeyExpiryTime(strings.Trim(parts[1], `"`))
+		return expiryTime, true, err
+	}
+
+	return time.Time{}, false, nil
+}
+
+// IsExpired reports whether key has 'expiry-time' option which is already
+// passed at specified moment. Key with invalid expiry time is treated as
+// expired, because sshd refuses such keys anyway.
+func (key *SSHKey) IsExpired(now time.Time) bool {
+	expiryTime, ok, err := key.GetExpiryTime()
+	if !ok {
+		return false
+	}
+
+	return err != nil || !now.Before(expiryTime)
+}
+
+// parseSSHKeyExpiryTime parses time in the same formats as sshd does:
+// YYYYMMDD, YYYYMMDDHHMM or YYYYMMDDHHMMSS, time is local unless it is
+// suffixed with 'Z', which means UTC.
+func parseSSHKeyExpiryTime(value string) (time.Time, error) {
+	location := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		location = time.UTC
+		value = value[:len(value)-1]
+	}
+
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry time %q", value)
+	}
+
+	expiryTime, err := time.ParseInLocation(layout, value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry time %q", value)
+	}
+
+	return expiryTime, nil
+}
+
+// FilterExpiredSSHKeys returns keys which are not expired at specified
+// moment, expired keys are logged and their amount is returned.
+func FilterExpiredSSHKeys(
+	keys AuthorizedKeys, now time.Time,
+) (AuthorizedKeys, int) {
+	alive := AuthorizedKeys{}
+	expired := 0
+
+	for username, userKeys := range keys {
+		alive[username] = SSHKeys{}
+
+		for _, key := range userKeys {
+			if key.IsExpired(now) {
+				infof(
+					"SSH key %s of user %s is expired, not installing it",
+					key.GetFingerprint(), username,
+				)
+
+				expired++
+				continue
+			}
+
+			alive[username] = append(alive[username], key)
+		}
+	}
+
+	return alive, expired
+}
+
+// RemoveExpiredSSHKeys removes keys which are expired at specified moment
+// from the file and returns removed keys.
+func (file *AuthorizedKeysFile) RemoveExpiredSSHKeys(now time.Time) SSHKeys {
+	removed := SSHKeys{}
+
+	lines := []*AuthorizedKeysLine{}
+	for _, line := range file.lines {
+		if line.Key != nil && line.Key.IsExpired(now) {
+			removed = append(removed, line.Key)
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	file.lines = lines
+
+	return removed
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSSHKeyExpiryTime(t *testing.T) {
+	testcases := []struct {
+		value    string
+		expected time.Time
+		valid    bool
+	}{
+		{
+			value:    "20300102",
+			expected: time.Date(2030, 1, 2, 0, 0, 0, 0, time.Local),
+			valid:    true,
+		},
+		{
+			value:    "203001021504",
+			expected: time.Date(2030, 1, 2, 15, 4, 0, 0, time.Local),
+			valid:    true,
+		},
+		{
+			value:    "20300102150405",
+			expected: time.Date(2030, 1, 2, 15, 4, 5, 0, time.Local),
+			valid:    true,
+		},
+		{
+			value:    "20300102Z",
+			expected: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC),
+			valid:    true,
+		},
+		{
+			value:    "20300102150405z",
+			expected: time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC),
+			valid:    true,
+		},
+		{value: ""},
+		{value: "Z"},
+		{value: "2030010"},
+		{value: "2030010215"},
+		{value: "203001021504050"},
+		{value: "20301302"},
+		{value: "20300102256000"},
+		{value: "2030-1-02"},
+	}
+
+	for _, testcase := range testcases {
+		expiryTime, err := parseSSHKeyExpiryTime(testcase.value)
+
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf(
+					"%q should not be parsed, got %s",
+					testcase.value, expiryTime,
+				)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", testcase.value, err)
+			continue
+		}
+
+		if !expiryTime.Equal(testcase.expected) {
+			t.Errorf(
+				"%q: expected %s, got %s",
+				testcase.value, testcase.expected, expiryTime,
+			)
+		}
+	}
+}
+
+func TestSSHKeyIsExpired(t *testing.T) {
+	now := time.Date(2030, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	testcases := []struct {
+		options string
+		expired bool
+	}{
+		{options: "", expired: false},
+		{options: `expiry-time="20300103Z" `, expired: false},
+		{options: `expiry-time="20300102Z" `, expired: true},
+		{options: `EXPIRY-TIME="203001021200Z" `, expired: true},
+		{options: `expiry-time="203001021201Z" `, expired: false},
+		{options: `expiry-time="invalid" `, expired: true},
+	}
+
+	for _, testcase := range testcases {
+		key := mustReadSSHKey(t, testcase.options+testSSHKeyEd25519)
+
+		if key.IsExpired(now) != testcase.expired {
+			t.Errorf(
+				"%q: expected expired to be %v",
+				testcase.options, testcase.expired,
+			)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/reconquest/hierr-go"
+)
+
+// SSHKeyOptionsRule specifies options which should be prepended to every SSH
+// key of users matching the pattern.
+//
+// Pattern is either <user> which matches user within any pool or
+// <pool>/<user>, both parts can contain shell wildcards.
+type SSHKeyOptionsRule struct {
+	pattern string
+	options []string
+}
+
+type SSHKeyOptionsRules []SSHKeyOptionsRule
+
+// sshKeySingleOptions are options which can be specified only once, sshd
+// refuses the whole key if any of them is repeated.
+var sshKeySingleOptions = []string{"from", "command", "principals"}
+
+// ReadSSHKeyOptionsRules reads rules file, which consists of lines in format
+// '<pattern> <options>', e.g.:
+//
+//	production/deploy from="10.0.0.0/8",no-agent-forwarding
+//	production/*      no-port-forwarding
+//
+// Empty lines and lines started with # are ignored. Missing file is treated
+// as empty.
+func ReadSSHKeyOptionsRules(rulesPath string) (SSHKeyOptionsRules, error) {
+	file, err := os.Open(rulesPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return SSHKeyOptionsRules{}, nil
+		}
+
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := SSHKeyOptionsRules{}
+	number := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		number++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		separator := strings.IndexAny(line, " \t")
+		if separator == -1 {
+			return nil, fmt.Errorf(
+				"invalid rule at line #%d, "+
+					"expected '<pattern> <options>'",
+				number,
+			)
+		}
+
+		pattern := line[:separator]
+
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, hierr.Errorf(
+				err, "invalid pattern at line #%d", number,
+			)
+		}
+
+		options, err := splitSSHKeyOptions(
+			strings.TrimSpace(line[separator:]),
+		)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err, "invalid options at line #%d", number,
+			)
+		}
+
+		rules = append(rules, SSHKeyOptionsRule{
+			pattern: pattern,
+			options: options,
+		})
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, hierr.Errorf(
+			err, "can't read SSH key options file",
+		)
+	}
+
+	return rules, nil
+}
+
+func (rule SSHKeyOptionsRule) Match(pool, username string) bool {
+	if !strings.Contains(rule.pattern, "/") {
+		matched, _ := path.Match(rule.pattern, username)
+		return matched
+	}
+
+	matched, _ := path.Match(rule.pattern, pool+"/"+username)
+	return matched
+}
+
+// GetOptions returns combined options of all rules matching specified user.
+func (rules SSHKeyOptionsRules) GetOptions(pool, username string) []string {
+	options := []string{}
+	for _, rule := range rules {
+		if rule.Match(pool, username) {
+			options = mergeSSHKeyOptions(options, rule.options)
+		}
+	}
+
+	return options
+}
+
+// Apply prepends options to keys of matching users. Key which already has
+// option allowed only once, like from= or command=, with value different
+// from the one specified by rules can't be restricted without dropping one
+// of them, so such key is rejected instead. Amount of rejected keys is
+// returned.
+func (rules SSHKeyOptionsRules) Apply(
+	keys AuthorizedKeys, pool string,
+) (AuthorizedKeys, int) {
+	result := AuthorizedKeys{}
+	rejected := 0
+
+	for username, userKeys := range keys {
+		options := rules.GetOptions(pool, username)
+		if len(options) == 0 {
+			result[username] = userKeys
+			continue
+		}
+
+		debugf(
+			"using options %s for ssh keys of %s",
+			strings.Join(options, ","), user{username, pool},
+		)
+
+		result[username] = SSHKeys{}
+		for _, key := range userKeys {
+			restricted := key.WithOptions(options)
+
+			repeated := getRepeatedSSHKeyOption(restricted.Options)
+			if repeated != "" {
+				warningf(
+					"SSH key %s of %s is rejected: option %s can be "+
+						"specified only once, but both key and options "+
+						"rules specify it",
+					key.GetFingerprint(), user{username, pool}, repeated,
+				)
+
+				rejected++
+				continue
+			}
+
+			result[username] = append(result[username], restricted)
+		}
+	}
+
+	return result, rejected
+}
+
+// WithOptions returns copy of the key with specified options prepended to
+// its own options. Options of the key are never replaced, so restrictions
+// received from shadowd can't be widened by options from rules.
+func (key *SSHKey) WithOptions(options []string) *SSHKey {
+	result := *key
+	result.Options = mergeSSHKeyOptions(options, key.Options)
+	result.Raw = result.String()
+
+	return &result
+}
+
+// mergeSSHKeyOptions returns options followed by additional options. Option
+// is skipped only if it duplicates flag or the same option with the same
+// value, because options like from= or permitopen= can be specified several
+// times and each of them is taken into account by sshd.
+func mergeSSHKeyOptions(options []string, additional []string) []string {
+	result := append([]string{}, options...)
+
+	for _, option := range additional {
+		found := false
+		for _, existing := range result {
+			if isSameSSHKeyOption(existing, option) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			result = append(result, option)
+		}
+	}
+
+	return result
+}
+
+func isSameSSHKeyOption(option, another string) bool {
+	return strings.EqualFold(
+		getSSHKeyOptionName(option), getSSHKeyOptionName(another),
+	) &&
+		strings.Contains(option, "=") == strings.Contains(another, "=") &&
+		getSSHKeyOptionValue(option) == getSSHKeyOptionValue(another)
+}
+
+// getRepeatedSSHKeyOption returns name of option which can be specified
+// only once, but is specified several times, or empty string.
+func getRepeatedSSHKeyOption(options []string) string {
+	found := map[string]bool{}
+
+	for _, option := range options {
+		name := strings.ToLower(getSSHKeyOptionName(option))
+
+		for _, single := range sshKeySingleOptions {
+			if name != single {
+				continue
+			}
+
+			if found[name] {
+				return name
+			}
+
+			found[name] = true
+		}
+	}
+
+	return ""
+}
+
+func getSSHKeyOptionName(option string) string {
+	return strings.SplitN(option, "=", 2)[0]
+}
+
+func getSSHKeyOptionValue(option string) string {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// splitSSHKeyOptions splits comma-separated options, commas inside of quoted
+// values are not treated as separators.
+func splitSSHKeyOptions(raw string) ([]string, error) {
+	options := []string{}
+
+	var (
+		option  = ""
+		quoted  = false
+		escaped = false
+	)
+
+	for _, char := range raw {
+		switch {
+		case escaped:
+			escaped = false
+
+		case char == '\\':
+			escaped = true
+
+		case char == '"':
+			quoted = !quoted
+
+		case char == ',' && !quoted:
+			if option == "" {
+				return nil, fmt.Errorf("empty option in %q", raw)
+			}
+
+			options = append(options, option)
+			option = ""
+			continue
+		}
+
+		option += string(char)
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in %q", raw)
+	}
+
+	if option == "" {
+		return nil, fmt.Errorf("empty option in %q", raw)
+	}
+
+	return append(options, option), nil
+}
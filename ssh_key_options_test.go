@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergeSSHKeyOptions(t *testing.T) {
+	testcases := []struct {
+		options    []string
+		additional []string
+		expected   []string
+	}{
+		{
+			options:    []string{"no-pty", "restrict"},
+			additional: []string{"NO-PTY", "restrict", "no-x11-forwarding"},
+			expected:   []string{"no-pty", "restrict", "no-x11-forwarding"},
+		},
+		{
+			options:    []string{`permitopen="a:22"`, `environment="A=1"`},
+			additional: []string{`permitopen="b:22"`, `environment="B=2"`},
+			expected: []string{
+				`permitopen="a:22"`, `environment="A=1"`,
+				`permitopen="b:22"`, `environment="B=2"`,
+			},
+		},
+		{
+			options:    []string{`from="10.0.0.0/8"`},
+			additional: []string{`from="10.0.0.0/8"`},
+			expected:   []string{`from="10.0.0.0/8"`},
+		},
+	}
+
+	for _, testcase := range testcases {
+		actual := mergeSSHKeyOptions(testcase.options, testcase.additional)
+		if strings.Join(actual, ",") != strings.Join(testcase.expected, ",") {
+			t.Errorf(
+				"merging %q with %q: expected %q, got %q",
+				testcase.options, testcase.additional,
+				testcase.expected, actual,
+			)
+		}
+	}
+}
+
+func TestSSHKeyWithOptionsKeepsKeyOptions(t *testing.T) {
+	key := mustReadSSHKey(t, `no-pty,from="10.0.0.1" `+testSSHKeyEd25519)
+
+	result := key.WithOptions([]string{"no-agent-forwarding", "no-pty"})
+
+	expected := `no-agent-forwarding,no-pty,from="10.0.0.1" ` +
+		testSSHKeyEd25519
+	if result.Raw != expected {
+		t.Fatalf("expected %q, got %q", expected, result.Raw)
+	}
+
+	if len(key.Options) != 2 {
+		t.Fatalf("original key should not be modified: %q", key.Options)
+	}
+}
+
+func TestSSHKeyOptionsRulesApply(t *testing.T) {
+	rules := SSHKeyOptionsRules{
+		{
+			pattern: "production/deploy",
+			options: []string{`from="10.0.0.0/8"`},
+		},
+	}
+
+	testcases := []struct {
+		key      string
+		expected string
+	}{
+		{
+			key:      testSSHKeyEd25519,
+			expected: `from="10.0.0.0/8" ` + testSSHKeyEd25519,
+		},
+		{
+			key:      `from="10.0.0.0/8" ` + testSSHKeyEd25519,
+			expected: `from="10.0.0.0/8" ` + testSSHKeyEd25519,
+		},
+		{
+			// sshd refuses key with several from= options, and dropping
+			// any of them widens access, so key is rejected.
+			key:      `FROM="*" ` + testSSHKeyEd25519,
+			expected: "",
+		},
+	}
+
+	for _, testcase := range testcases {
+		keys, rejected := rules.Apply(
+			AuthorizedKeys{
+				"deploy": SSHKeys{mustReadSSHKey(t, testcase.key)},
+			},
+			"production",
+		)
+
+		if testcase.expected == "" {
+			if rejected != 1 || len(keys["deploy"]) != 0 {
+				t.Errorf("key %q should be rejected", testcase.key)
+			}
+
+			continue
+		}
+
+		if rejected != 0 || len(keys["deploy"]) != 1 ||
+			keys["deploy"][0].Raw != testcase.expected {
+			t.Errorf(
+				"key %q: expected %q, got %v",
+				testcase.key, testcase.expected, keys["deploy"],
+			)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKeyTypeAliases maps short names, which can be used in policy, to
+// prefixes of key types.
+var sshKeyTypeAliases = map[string]string{
+	"dsa":     ssh.KeyAlgoDSA,
+	"rsa":     ssh.KeyAlgoRSA,
+	"ecdsa":   "ecdsa-sha2-",
+	"ed25519": ssh.KeyAlgoED25519,
+}
+
+// sshKeyTypes lists key types which can be specified in policy by full
+// name.
+var sshKeyTypes = []string{
+	ssh.KeyAlgoDSA,
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoSKED25519,
+}
+
+// SSHKeyPolicy describes which SSH keys received from shadowd are allowed to
+// be installed on the host.
+type SSHKeyPolicy struct {
+	deniedTypes     []string
+	minRSABits      int
+	requiredOptions []string
+	onlySKKeys      bool
+}
+
+func NewSSHKeyPolicy(
+	deniedTypes string, minRSABits string, requiredOptions string,
+	onlySKKeys bool,
+) (*SSHKeyPolicy, error) {
+	policy := &SSHKeyPolicy{
+		deniedTypes:     splitList(deniedTypes),
+		requiredOptions: splitList(requiredOptions),
+		onlySKKeys:      onlySKKeys,
+	}
+
+	for index, keyType := range policy.deniedTypes {
+		if prefix, ok := sshKeyTypeAliases[keyType]; ok {
+			policy.deniedTypes[index] = prefix
+			continue
+		}
+
+		if !isKnownSSHKeyType(keyType) {
+			return nil, fmt.Errorf(
+				"unknown key type %q, expected one of: %s, or short one: %s",
+				keyType, strings.Join(sshKeyTypes, ", "),
+				strings.Join(getSSHKeyTypeAliases(), ", "),
+			)
+		}
+	}
+
+	if minRSABits != "" {
+		var err error
+		policy.minRSABits, err = strconv.Atoi(minRSABits)
+		if err != nil || policy.minRSABits < 0 {
+			return nil, fmt.Errorf("invalid RSA key size %q", minRSABits)
+		}
+	}
+
+	return policy, nil
+}
+
+// Check returns error describing violation of the policy or nil if key is
+// allowed.
+func (policy *SSHKeyPolicy) Check(key *SSHKey) error {
+	for _, deniedType := range policy.deniedTypes {
+		if strings.HasPrefix(key.Type, deniedType) {
+			return fmt.Errorf("key type %s is not allowed", key.Type)
+		}
+	}
+
+	if policy.onlySKKeys && !strings.HasPrefix(key.Type, "sk-") {
+		return fmt.Errorf(
+			"key type %s is not allowed, only FIDO keys are allowed",
+			key.Type,
+		)
+	}
+
+	if policy.minRSABits > 0 && key.Type == ssh.KeyAlgoRSA {
+		bits := getRSAKeyBits(key)
+		if bits < policy.minRSABits {
+			return fmt.Errorf(
+				"RSA key size %d is less than required %d bits",
+				bits, policy.minRSABits,
+			)
+		}
+	}
+
+	for _, option := range policy.requiredOptions {
+		if !key.HasOption(option) {
+			return fmt.Errorf("required option %s is missing", option)
+		}
+	}
+
+	return nil
+}
+
+// Filter returns keys which are allowed by the policy, rejected keys are
+// logged and their amount is returned.
+func (policy *SSHKeyPolicy) Filter(keys AuthorizedKeys) (AuthorizedKeys, int) {
+	allowed := AuthorizedKeys{}
+	rejected := 0
+
+	for username, userKeys := range keys {
+		allowed[username] = SSHKeys{}
+
+		for _, key := range userKeys {
+			err := policy.Check(key)
+			if err != nil {
+				warningh(
+					err, "SSH key %s of user %s rejected by policy",
+					key.GetFingerprint(), username,
+				)
+
+				rejected++
+				continue
+			}
+
+			allowed[username] = append(allowed[username], key)
+		}
+	}
+
+	return allowed, rejected
+}
+
+func getRSAKeyBits(key *SSHKey) int {
+	cryptoPublicKey, ok := key.PublicKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+
+	rsaPublicKey, ok := cryptoPublicKey.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return 0
+	}
+
+	return rsaPublicKey.N.BitLen()
+}
+
+func isKnownSSHKeyType(keyType string) bool {
+	for _, knownType := range sshKeyTypes {
+		if keyType == knownType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getSSHKeyTypeAliases() []string {
+	aliases := []string{}
+	for alias := range sshKeyTypeAliases {
+		aliases = append(aliases, alias)
+	}
+
+	sort.Strings(aliases)
+
+	return aliases
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
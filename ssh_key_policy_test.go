@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewSSHKeyPolicyDeniedTypes(t *testing.T) {
+	testcases := []struct {
+		deniedTypes string
+		valid       bool
+	}{
+		{"", true},
+		{"dsa, rsa,ecdsa,ed25519", true},
+		{"ssh-dss,ecdsa-sha2-nistp521,sk-ssh-ed25519@openssh.com", true},
+		{"dss", false},
+		{"rsa,ed25591", false},
+		{"ssh-rsa-cert", false},
+	}
+
+	for _, testcase := range testcases {
+		_, err := NewSSHKeyPolicy(testcase.deniedTypes, "", "", false)
+		if testcase.valid && err != nil {
+			t.Errorf("%q: unexpected error: %s", testcase.deniedTypes, err)
+		}
+
+		if !testcase.valid && err == nil {
+			t.Errorf("%q: error expected", testcase.deniedTypes)
+		}
+	}
+}
+
+func TestSSHKeyPolicyCheckDeniedTypes(t *testing.T) {
+	policy, err := NewSSHKeyPolicy("ed25519", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if policy.Check(mustReadSSHKey(t, testSSHKeyEd25519)) == nil {
+		t.Fatal("denied key type should be rejected")
+	}
+
+	policy, err = NewSSHKeyPolicy("ssh-dss", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := policy.Check(mustReadSSHKey(t, testSSHKeyEd25519)); err != nil {
+		t.Fatalf("allowed key type should be accepted: %s", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/reconquest/hierr-go"
+)
+
+// getRevokedSSHKeys retrieves list of revoked keys of specified pool, nil is
+// returned if shadowd servers are not aware of revoked keys. Error is
+// returned if revoked keys can't be retrieved because servers have failed,
+// so revocation is never skipped silently.
+func getRevokedSSHKeys(
+	upstream *ShadowdUpstream, pool string,
+) (SSHKeys, error) {
+	shadowdHosts, err := upstream.GetAliveShadowdHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	// hosts which have failed earlier are not returned at all.
+	if len(shadowdHosts) == 0 {
+		return nil, errors.New("all shadowd servers has gone away")
+	}
+
+	hostsFailed := 0
+
+	for _, shadowdHost := range shadowdHosts {
+		keys, err := shadowdHost.GetRevokedSSHKeys(pool)
+		if err != nil {
+			switch err.(type) {
+			case NotFoundError:
+				warningf(
+					"[%s] is not aware of revoked ssh keys for pool '%s'",
+					shadowdHost.GetAddr(), pool,
+				)
+
+			default:
+				shadowdHost.SetIsAlive(false)
+
+				errorh(err, "[%s] has gone away", shadowdHost.GetAddr())
+
+				hostsFailed++
+			}
+
+			continue
+		}
+
+		return keys, nil
+	}
+
+	// server which has failed could be aware of revoked keys, so missing
+	// keys can't be treated as no revoked keys.
+	if hostsFailed > 0 {
+		return nil, fmt.Errorf(
+			"%d of %d shadowd servers have failed and others are not "+
+				"aware of revoked ssh keys for pool '%s'",
+			hostsFailed, len(shadowdHosts), pool,
+		)
+	}
+
+	return nil, nil
+}
+
+// readRevokedSSHKeysFile reads revoked keys written by previous run of
+// shadowc, nil is returned if path is empty or file does not exist.
+func readRevokedSSHKeysFile(path string) (SSHKeys, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	keysFile, err := ReadAuthorizedKeysFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return keysFile.GetSSHKeys(), nil
+}
+
+// removeRevokedSSHKeysFromContents removes revoked keys from specified
+// authorized_keys contents.
+func removeRevokedSSHKeysFromContents(
+	contents []byte, revokedKeys SSHKeys,
+) ([]byte, error) {
+	if len(revokedKeys) == 0 {
+		return contents, nil
+	}
+
+	keysFile, err := ReadAuthorizedKeys(bytes.NewReader(contents), "cache")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keysFile.RemoveSSHKeys(revokedKeys) {
+		warningf("SSH key %s is revoked, not using it", key.GetFingerprint())
+	}
+
+	buffer := &bytes.Buffer{}
+
+	_, err = keysFile.Write(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// FilterRevokedSSHKeys returns keys which are not revoked, revoked keys are
+// logged and their amount is returned.
+func FilterRevokedSSHKeys(
+	keys AuthorizedKeys, revokedKeys SSHKeys,
+) (AuthorizedKeys, int) {
+	allowed := AuthorizedKeys{}
+	revoked := 0
+
+	for username, userKeys := range keys {
+		allowed[username] = SSHKeys{}
+
+		for _, key := range userKeys {
+			if revokedKeys.Contains(key) {
+				warningf(
+					"SSH key %s of user %s is revoked, not installing it",
+					key.GetFingerprint(), username,
+				)
+
+				revoked++
+				continue
+			}
+
+			allowed[username] = append(allowed[username], key)
+		}
+	}
+
+	return allowed, revoked
+}
+
+// removeRevokedSSHKeys removes revoked keys from existing authorized_keys
+// file of the user, file is rewritten only if it contains revoked keys.
+// Missing files and directories are never created.
+func removeRevokedSSHKeys(
+	user string, path string, isUserOwned bool, revokedKeys SSHKeys,
+	transaction *Transaction,
+) error {
+	dir, fileMode, err := openSecureFileDirectory(
+		user, path, isUserOwned, false,
+	)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+	defer dir.Close()
+
+	name := filepath.Base(path)
+
+	authorizedKeysFile, err := readSecureAuthorizedKeysFile(dir, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return hierr.Errorf(
+			err, "can't read authorized keys file %s", path,
+		)
+	}
+
+	removedKeys := authorizedKeysFile.RemoveSSHKeys(revokedKeys)
+	if len(removedKeys) == 0 {
+		return nil
+	}
+
+	for _, sshKey := range removedKeys {
+		warningf(
+			"revoked SSH key %s removed from user %s",
+			sshKey.GetFingerprint(), user,
+		)
+	}
+
+	return transaction.Stage(
+		dir, name, BackupKindAuthorizedKeys, fileMode, authorizedKeysFile,
+		nil,
+	)
+}
+
+// removeRevokedSSHKeysOfLocalUsers removes revoked keys from authorized_keys
+// files of all local users which are not managed by shadowc during this run,
+// so compromised key stops working for every account on the host. Files
+// which can't be processed are reported, but don't prevent updating other
+// users.
+func removeRevokedSSHKeysOfLocalUsers(
+	managedUsers []string, passwdFilePath string, homeDirs map[string]string,
+	pathTemplate string, isUserOwned bool, revokedKeys SSHKeys,
+	transaction *Transaction,
+) error {
+	localUsers, err := getPasswdUsers(passwdFilePath)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't get users from passwd file %s", passwdFilePath,
+		)
+	}
+
+	for _, user := range managedUsers {
+		delete(localUsers, user)
+	}
+
+	usernames := []string{}
+	for username := range localUsers {
+		usernames = append(usernames, username)
+	}
+
+	sort.Strings(usernames)
+
+	for _, user := range usernames {
+		home, ok := homeDirs[user]
+		if !ok && isUserOwned {
+			continue
+		}
+
+		path, err := expandAuthorizedKeysPath(pathTemplate, user, home)
+		if err != nil {
+			errorh(
+				err, "can't get authorized keys file path for user %s",
+				user,
+			)
+
+			continue
+		}
+
+		err = removeRevokedSSHKeys(
+			user, path, isUserOwned, revokedKeys, transaction,
+		)
+		if err != nil {
+			errorh(err, "can't remove revoked ssh keys of user %s", user)
+		}
+	}
+
+	return nil
+}
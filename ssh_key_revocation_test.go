@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSSHKeyEd25519 = "ssh-ed25519 " +
+		"AAAAC3NzaC1lZDI1NTE5AAAAIOkCEO6XI0/yJRpvnBbMhzpy0a9x/I19yKG2xExPyVVa " +
+		"ed25519@test"
+	testSSHKeyEd25519Another = "ssh-ed25519 " +
+		"AAAAC3NzaC1lZDI1NTE5AAAAIPUHzC9sUAsJFVolHmOTHoFLjtJo70qhCSsuOezGeJ6Q " +
+		"another@test"
+)
+
+func mustReadSSHKey(t *testing.T, raw string) *SSHKey {
+	key, err := ReadSSHKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestRemoveRevokedSSHKeysFromContents(t *testing.T) {
+	revokedKeys := SSHKeys{mustReadSSHKey(t, testSSHKeyEd25519)}
+
+	contents, err := removeRevokedSSHKeysFromContents(
+		[]byte("no-pty "+testSSHKeyEd25519+"\n"+testSSHKeyEd25519Another+"\n"),
+		revokedKeys,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != testSSHKeyEd25519Another+"\n" {
+		t.Fatalf("unexpected contents: %q", contents)
+	}
+}
+
+func TestRemoveRevokedSSHKeysDoesNotCreateDirectories(t *testing.T) {
+	root := t.TempDir()
+
+	transaction, err := NewTransaction(
+		filepath.Join(root, "state"), time.Second, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transaction.Abort()
+
+	path := filepath.Join(root, "home", ".ssh", "authorized_keys")
+
+	err = removeRevokedSSHKeys(
+		"root", path, false, SSHKeys{mustReadSSHKey(t, testSSHKeyEd25519)},
+		transaction,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(root, "home"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("missing directory should not be created: %v", err)
+	}
+}
+
+func TestRemoveRevokedSSHKeys(t *testing.T) {
+	root := t.TempDir()
+
+	path := filepath.Join(root, "authorized_keys")
+
+	err := ioutil.WriteFile(
+		path,
+		[]byte(testSSHKeyEd25519+"\n"+testSSHKeyEd25519Another+"\n"),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction, err := NewTransaction(
+		filepath.Join(root, "state"), time.Second, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = removeRevokedSSHKeys(
+		"root", path, false, SSHKeys{mustReadSSHKey(t, testSSHKeyEd25519)},
+		transaction,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != testSSHKeyEd25519Another+"\n" {
+		t.Fatalf("unexpected contents: %q", contents)
+	}
+}
+
+// newTestShadowdUpstream returns upstream with shadowd server per specified
+// handler.
+func newTestShadowdUpstream(
+	t *testing.T, handlers ...http.HandlerFunc,
+) *ShadowdUpstream {
+	upstream := &ShadowdUpstream{}
+
+	for _, handler := range handlers {
+		server := httptest.NewTLSServer(handler)
+		t.Cleanup(server.Close)
+
+		host, err := NewShadowdHost(
+			strings.TrimPrefix(server.URL, "https://"), server.Client(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		upstream.hosts = append(upstream.hosts, host)
+	}
+
+	return upstream
+}
+
+func TestGetRevokedSSHKeys(t *testing.T) {
+	var (
+		notFound = func(writer http.ResponseWriter, _ *http.Request) {
+			writer.WriteHeader(http.StatusNotFound)
+		}
+
+		failed = func(writer http.ResponseWriter, _ *http.Request) {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+
+		revoked = func(writer http.ResponseWriter, _ *http.Request) {
+			writer.Write([]byte(testSSHKeyEd25519 + "\n"))
+		}
+	)
+
+	testcases := []struct {
+		name     string
+		handlers []http.HandlerFunc
+		keys     int
+		valid    bool
+	}{
+		{"not aware", []http.HandlerFunc{notFound, notFound}, 0, true},
+		{"all failed", []http.HandlerFunc{failed, failed}, 0, false},
+		{"failed, not aware", []http.HandlerFunc{failed, notFound}, 0, false},
+		{"failed, found", []http.HandlerFunc{failed, revoked}, 1, true},
+	}
+
+	for _, testcase := range testcases {
+		keys, err := getRevokedSSHKeys(
+			newTestShadowdUpstream(t, testcase.handlers...), "production",
+		)
+
+		if (err == nil) != testcase.valid || len(keys) != testcase.keys {
+			t.Errorf(
+				"%s: unexpected result: %d keys, %v",
+				testcase.name, len(keys), err,
+			)
+		}
+	}
+
+	upstream := newTestShadowdUpstream(t, revoked)
+	upstream.hosts[0].SetIsAlive(false)
+
+	_, err := getRevokedSSHKeys(upstream, "production")
+	if err == nil {
+		t.Fatal("revoked keys can't be retrieved if all servers are gone")
+	}
+}
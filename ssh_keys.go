@@ -2,29 +2,82 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/reconquest/hierr-go"
 
 	"golang.org/x/crypto/ssh"
 )
 
+const (
+	authorizedKeysBlockBegin = "# BEGIN SHADOWC MANAGED KEYS"
+	authorizedKeysBlockEnd   = "# END SHADOWC MANAGED KEYS"
+
+	authorizedKeysBlockNotice = " -- do not edit, " +
+		"keys in this block are overwritten by shadowc"
+)
+
+// AuthorizedKeysMode specifies how keys retrieved from shadowd are written
+// into authorized_keys file.
+type AuthorizedKeysMode int
+
+const (
+	// AuthorizedKeysModeAppend adds new keys to the end of file and never
+	// removes existing keys.
+	AuthorizedKeysModeAppend AuthorizedKeysMode = iota
+
+	// AuthorizedKeysModeOverwrite replaces whole file with retrieved keys.
+	AuthorizedKeysModeOverwrite
+
+	// AuthorizedKeysModeManaged replaces keys only inside block delimited by
+	// marker comments and preserves all lines outside of that block.
+	AuthorizedKeysModeManaged
+)
+
+// AuthorizedKeysChange describes how authorized_keys file has been changed
+// after adding a key.
+type AuthorizedKeysChange int
+
+const (
+	AuthorizedKeysChangeNone AuthorizedKeysChange = iota
+	AuthorizedKeysChangeAdded
+	AuthorizedKeysChangeUpdated
+)
+
+// SSHKey represents single key entry of authorized_keys file in format:
+// [options] <type> <base64 encoded key> [comment].
 type SSHKey struct {
-	Comment string
-	Raw     string
+	Options   []string
+	Type      string
+	PublicKey ssh.PublicKey
+	Comment   string
+	Raw       string
 }
 
 type SSHKeys []*SSHKey
 type AuthorizedKeys map[string]SSHKeys
 
+// AuthorizedKeysLine is a single line of authorized_keys file. Key is nil
+// for blank lines, comments and lines which can't be parsed, such lines are
+// written back verbatim.
+type AuthorizedKeysLine struct {
+	Raw string
+	Key *SSHKey
+}
+
 type AuthorizedKeysFile struct {
-	path string
-	keys SSHKeys
+	path  string
+	lines []*AuthorizedKeysLine
 }
 
 func ReadSSHKey(key string) (*SSHKey, error) {
-	_, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	publicKey, comment, options, _, err := ssh.ParseAuthorizedKey(
+		[]byte(key),
+	)
 	if err != nil {
 		return nil, hierr.Errorf(
 			err, "can't parse authorized key",
@@ -32,8 +85,11 @@ func ReadSSHKey(key string) (*SSHKey, error) {
 	}
 
 	return &SSHKey{
-		Comment: comment,
-		Raw:     key,
+		Options:   options,
+		Type:      publicKey.Type(),
+		PublicKey: publicKey,
+		Comment:   comment,
+		Raw:       key,
 	}, nil
 }
 
@@ -41,55 +97,411 @@ func (key *SSHKey) GetComment() string {
 	return key.Comment
 }
 
+// GetFingerprint returns SHA256 fingerprint of the public key in the same
+// format as ssh-keygen does.
+func (key *SSHKey) GetFingerprint() string {
+	return ssh.FingerprintSHA256(key.PublicKey)
+}
+
+// IsSame reports whether both keys are the same public key, regardless of
+// options, comments and formatting.
+func (key *SSHKey) IsSame(another *SSHKey) bool {
+	return key.Type == another.Type &&
+		key.GetFingerprint() == another.GetFingerprint()
+}
+
+// IsEqual reports whether both keys are the same public key with the same
+// options and comment.
+func (key *SSHKey) IsEqual(another *SSHKey) bool {
+	return key.IsSame(another) && key.String() == another.String()
+}
+
+// HasOption reports whether key has specified option, option value is not
+// taken into account, so 'from' matches 'from="10.0.0.0/8"'.
+func (key *SSHKey) HasOption(name string) bool {
+	for _, option := range key.Options {
+		if strings.EqualFold(getSSHKeyOptionName(option), name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns key in authorized_keys format rendered from its fields.
+func (key *SSHKey) String() string {
+	parts := []string{}
+
+	if len(key.Options) > 0 {
+		parts = append(parts, strings.Join(key.Options, ","))
+	}
+
+	parts = append(
+		parts,
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.PublicKey))),
+	)
+
+	if key.Comment != "" {
+		parts = append(parts, key.Comment)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func isAuthorizedKeysComment(line string) bool {
+	line = strings.TrimSpace(line)
+
+	return line == "" || strings.HasPrefix(line, "#")
+}
+
+// expandAuthorizedKeysPath expands tokens of path template in the same way
+// as sshd does for AuthorizedKeysFile: '%u' is replaced with user name, '%h'
+// with user home directory and '%%' with literal '%'.
+func expandAuthorizedKeysPath(
+	template string, username string, home string,
+) (string, error) {
+	if strings.Contains(username, "/") || username == ".." {
+		return "", fmt.Errorf("invalid user name %q", username)
+	}
+
+	path := ""
+
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			path += string(template[i])
+			continue
+		}
+
+		if i+1 == len(template) {
+			return "", fmt.Errorf("unterminated token in %q", template)
+		}
+
+		i++
+
+		switch template[i] {
+		case 'u':
+			path += username
+
+		case 'h':
+			// empty home would turn path into path relative to /.
+			if home == "" {
+				return "", fmt.Errorf(
+					"home directory of user %s is empty", username,
+				)
+			}
+
+			path += home
+
+		case '%':
+			path += "%"
+
+		default:
+			return "", fmt.Errorf(
+				"unknown token %%%c in %q", template[i], template,
+			)
+		}
+	}
+
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("path %q is not absolute", path)
+	}
+
+	return filepath.Clean(path), nil
+}
+
 func NewAuthorizedKeysFile(path string) *AuthorizedKeysFile {
 	return &AuthorizedKeysFile{
 		path: path,
 	}
 }
 
+// ReadAuthorizedKeysFile reads and parses authorized_keys file. Blank lines,
+// comments and lines which are not valid keys are preserved as is.
 func ReadAuthorizedKeysFile(path string) (*AuthorizedKeysFile, error) {
 	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadAuthorizedKeys(file, path)
+}
+
+// ReadAuthorizedKeys parses authorized_keys file contents from specified
+// reader, path is used only for reporting.
+func ReadAuthorizedKeys(
+	reader io.Reader, path string,
+) (*AuthorizedKeysFile, error) {
+	authorizedKeysFile := &AuthorizedKeysFile{
+		path: path,
+	}
+
+	var err error
+
+	number := 0
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		number++
+
+		line := &AuthorizedKeysLine{
+			Raw: scanner.Text(),
+		}
+
+		if !isAuthorizedKeysComment(line.Raw) {
+			line.Key, err = ReadSSHKey(line.Raw)
+			if err != nil {
+				warningh(
+					err, "line #%d of %s is not valid SSH key, "+
+						"keeping it as is",
+					number, path,
+				)
+			}
+		}
+
+		authorizedKeysFile.lines = append(authorizedKeysFile.lines, line)
+	}
+
+	err = scanner.Err()
 	if err != nil {
 		return nil, hierr.Errorf(
-			err, "can't open authorized keys file",
+			err, "can't read authorized keys file",
 		)
 	}
 
-	sshKeys := SSHKeys{}
+	_, _, err = authorizedKeysFile.getManagedBlock()
+	if err != nil {
+		return nil, err
+	}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		key, err := ReadSSHKey(scanner.Text())
-		if err != nil {
-			return nil, err
+	return authorizedKeysFile, nil
+}
+
+// getManagedBlock returns indexes of begin and end markers of the block
+// managed by shadowc or -1 if file has no such block.
+func (file *AuthorizedKeysFile) getManagedBlock() (int, int, error) {
+	begin, end := -1, -1
+
+	for index, line := range file.lines {
+		switch {
+		case strings.HasPrefix(line.Raw, authorizedKeysBlockBegin):
+			if begin != -1 {
+				return 0, 0, fmt.Errorf(
+					"unexpected begin of shadowc block at line #%d",
+					index+1,
+				)
+			}
+
+			begin = index
+
+		case strings.HasPrefix(line.Raw, authorizedKeysBlockEnd):
+			if begin == -1 || end != -1 {
+				return 0, 0, fmt.Errorf(
+					"unexpected end of shadowc block at line #%d",
+					index+1,
+				)
+			}
+
+			end = index
 		}
+	}
 
-		sshKeys = append(sshKeys, key)
+	if begin != -1 && end == -1 {
+		return 0, 0, fmt.Errorf(
+			"shadowc block started at line #%d is not terminated",
+			begin+1,
+		)
 	}
 
-	return &AuthorizedKeysFile{
-		path: path,
-		keys: sshKeys,
-	}, nil
+	return begin, end, nil
+}
+
+// SetManagedSSHKeys replaces keys in the block managed by shadowc with
+// specified keys and returns keys which are added, keys which are updated
+// (same public key with different options or comment) and keys which are
+// removed. Block is appended to the end of file if it does not exist yet.
+func (file *AuthorizedKeysFile) SetManagedSSHKeys(
+	keys SSHKeys,
+) (SSHKeys, SSHKeys, SSHKeys, error) {
+	begin, end, err := file.getManagedBlock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if begin == -1 {
+		file.lines = append(
+			file.lines,
+			&AuthorizedKeysLine{
+				Raw: authorizedKeysBlockBegin + authorizedKeysBlockNotice,
+			},
+			&AuthorizedKeysLine{
+				Raw: authorizedKeysBlockEnd,
+			},
+		)
+
+		begin, end = len(file.lines)-2, len(file.lines)-1
+	}
+
+	managedKeys := SSHKeys{}
+	for _, line := range file.lines[begin+1 : end] {
+		if line.Key != nil {
+			managedKeys = append(managedKeys, line.Key)
+		}
+	}
+
+	keys = keys.Unique()
+
+	added := SSHKeys{}
+	updated := SSHKeys{}
+	for _, key := range keys {
+		index := managedKeys.Find(key)
+		switch {
+		case index == -1:
+			added = append(added, key)
+
+		case !managedKeys[index].IsEqual(key):
+			updated = append(updated, key)
+		}
+	}
+
+	removed := SSHKeys{}
+	for _, key := range managedKeys {
+		if keys.Find(key) == -1 {
+			removed = append(removed, key)
+		}
+	}
+
+	block := []*AuthorizedKeysLine{}
+	for _, key := range keys {
+		block = append(block, &AuthorizedKeysLine{Raw: key.Raw, Key: key})
+	}
+
+	lines := append([]*AuthorizedKeysLine{}, file.lines[:begin+1]...)
+	lines = append(lines, block...)
+	lines = append(lines, file.lines[end:]...)
+
+	file.lines = lines
+
+	return added, updated, removed, nil
 }
 
-func (file *AuthorizedKeysFile) AddSSHKey(key *SSHKey) bool {
-	for _, existKey := range file.keys {
-		if existKey.Raw == key.Raw {
-			return false
+// GetSSHKeys returns all keys found in file.
+func (file *AuthorizedKeysFile) GetSSHKeys() SSHKeys {
+	keys := SSHKeys{}
+	for _, line := range file.lines {
+		if line.Key != nil {
+			keys = append(keys, line.Key)
 		}
 	}
 
-	file.keys = append(file.keys, key)
+	return keys
+}
+
+// Find returns index of the same public key as specified or -1 if there is
+// no such key.
+func (keys SSHKeys) Find(key *SSHKey) int {
+	for index, existKey := range keys {
+		if existKey.IsSame(key) {
+			return index
+		}
+	}
+
+	return -1
+}
+
+func (keys SSHKeys) Contains(key *SSHKey) bool {
+	return keys.Find(key) != -1
+}
+
+// Unique returns keys without duplicates of the same public key, first
+// occurrence of each key is kept.
+func (keys SSHKeys) Unique() SSHKeys {
+	unique := SSHKeys{}
+	for _, key := range keys {
+		if !unique.Contains(key) {
+			unique = append(unique, key)
+		}
+	}
+
+	return unique
+}
+
+// RemoveSSHKeys removes all occurrences of specified public keys from the
+// whole file, including lines outside of the block managed by shadowc, and
+// returns removed keys.
+func (file *AuthorizedKeysFile) RemoveSSHKeys(keys SSHKeys) SSHKeys {
+	removed := SSHKeys{}
+
+	lines := []*AuthorizedKeysLine{}
+	for _, line := range file.lines {
+		if line.Key != nil && keys.Contains(line.Key) {
+			removed = append(removed, line.Key)
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	file.lines = lines
+
+	return removed
+}
+
+// AddComment adds comment line to the end of file.
+func (file *AuthorizedKeysFile) AddComment(comment string) {
+	file.lines = append(file.lines, &AuthorizedKeysLine{Raw: comment})
+}
+
+// AddSSHKey adds specified key to the end of file. If file already contains
+// the same public key, key received from shadowd takes precedence: first
+// occurrence is replaced with specified key, including its options and
+// comment, and other occurrences are removed.
+func (file *AuthorizedKeysFile) AddSSHKey(key *SSHKey) AuthorizedKeysChange {
+	var (
+		change = AuthorizedKeysChangeNone
+		found  = false
+	)
+
+	lines := []*AuthorizedKeysLine{}
+	for _, line := range file.lines {
+		if line.Key == nil || !line.Key.IsSame(key) {
+			lines = append(lines, line)
+			continue
+		}
+
+		if found {
+			change = AuthorizedKeysChangeUpdated
+			continue
+		}
+
+		found = true
+
+		if !line.Key.IsEqual(key) {
+			change = AuthorizedKeysChangeUpdated
+			line = &AuthorizedKeysLine{Raw: key.Raw, Key: key}
+		}
+
+		lines = append(lines, line)
+	}
+
+	if !found {
+		change = AuthorizedKeysChangeAdded
+		lines = append(lines, &AuthorizedKeysLine{
+			Raw: key.Raw,
+			Key: key,
+		})
+	}
+
+	file.lines = lines
 
-	return true
+	return change
 }
 
 func (file *AuthorizedKeysFile) Write(writer io.Writer) (int, error) {
 	totalWritten := 0
 
-	for _, key := range file.keys {
-		written, err := io.WriteString(writer, string(key.Raw)+"\n")
+	for _, line := range file.lines {
+		written, err := io.WriteString(writer, line.Raw+"\n")
 		if err != nil {
 			return totalWritten, err
 		}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadAuthorizedKeys(t *testing.T) {
+	testcases := []struct {
+		name     string
+		contents string
+		keys     int
+		valid    bool
+	}{
+		{
+			name:     "plain keys and comments",
+			contents: "# comment\n\n" + testSSHKeyEd25519 + "\n",
+			keys:     1,
+			valid:    true,
+		},
+		{
+			name: "managed block",
+			contents: testSSHKeyEd25519Another + "\n" +
+				authorizedKeysBlockBegin + authorizedKeysBlockNotice + "\n" +
+				`no-pty ` + testSSHKeyEd25519 + "\n" +
+				authorizedKeysBlockEnd + "\n",
+			keys:  2,
+			valid: true,
+		},
+		{
+			name:     "invalid key is kept",
+			contents: "ssh-ed25519 garbage\n" + testSSHKeyEd25519 + "\n",
+			keys:     1,
+			valid:    true,
+		},
+		{
+			name: "block is not terminated",
+			contents: authorizedKeysBlockBegin + "\n" +
+				testSSHKeyEd25519 + "\n",
+		},
+		{
+			name: "block is started twice",
+			contents: authorizedKeysBlockBegin + "\n" +
+				authorizedKeysBlockBegin + "\n" +
+				authorizedKeysBlockEnd + "\n",
+		},
+		{
+			name:     "block end without begin",
+			contents: authorizedKeysBlockEnd + "\n",
+		},
+	}
+
+	for _, testcase := range testcases {
+		keysFile, err := ReadAuthorizedKeys(
+			strings.NewReader(testcase.contents), "authorized_keys",
+		)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%s: error expected", testcase.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", testcase.name, err)
+			continue
+		}
+
+		if len(keysFile.GetSSHKeys()) != testcase.keys {
+			t.Errorf(
+				"%s: expected %d keys, got %d",
+				testcase.name, testcase.keys, len(keysFile.GetSSHKeys()),
+			)
+		}
+
+		buffer := &bytes.Buffer{}
+
+		_, err = keysFile.Write(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if buffer.String() != testcase.contents {
+			t.Errorf(
+				"%s: contents are changed after round-trip: %q",
+				testcase.name, buffer.String(),
+			)
+		}
+	}
+}
+
+func TestSetManagedSSHKeys(t *testing.T) {
+	keysFile, err := ReadAuthorizedKeys(
+		strings.NewReader(
+			testSSHKeyEd25519Another+"\n"+
+				authorizedKeysBlockBegin+"\n"+
+				testSSHKeyEd25519+"\n"+
+				authorizedKeysBlockEnd+"\n",
+		),
+		"authorized_keys",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, updated, removed, err := keysFile.SetManagedSSHKeys(SSHKeys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(added) != 0 || len(updated) != 0 || len(removed) != 1 {
+		t.Fatalf(
+			"unexpected changes: %d added, %d updated, %d removed",
+			len(added), len(updated), len(removed),
+		)
+	}
+
+	buffer := &bytes.Buffer{}
+
+	_, err = keysFile.Write(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := testSSHKeyEd25519Another + "\n" +
+		authorizedKeysBlockBegin + "\n" +
+		authorizedKeysBlockEnd + "\n"
+	if buffer.String() != expected {
+		t.Fatalf("unexpected contents: %q", buffer.String())
+	}
+}
+
+func TestWriteAuthorizedKeysFileWithoutKeys(t *testing.T) {
+	root := t.TempDir()
+
+	transaction, err := NewTransaction(
+		filepath.Join(root, "state"), time.Second, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := filepath.Join(root, "missing", "authorized_keys")
+
+	_, err = writeAuthorizedKeysFile(
+		"root", missing, SSHKeys{}, AuthorizedKeysModeManaged, false, nil,
+		transaction,
+	)
+	if !os.IsNotExist(err) {
+		t.Fatalf("missing file should be reported: %v", err)
+	}
+
+	_, err = os.Stat(filepath.Dir(missing))
+	if !os.IsNotExist(err) {
+		t.Fatal("missing directory should not be created")
+	}
+
+	path := filepath.Join(root, "authorized_keys")
+
+	err = ioutil.WriteFile(
+		path,
+		[]byte(
+			authorizedKeysBlockBegin+"\n"+
+				testSSHKeyEd25519+"\n"+
+				authorizedKeysBlockEnd+"\n",
+		),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = writeAuthorizedKeysFile(
+		"root", path, SSHKeys{}, AuthorizedKeysModeManaged, false, nil,
+		transaction,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != authorizedKeysBlockBegin+"\n"+
+		authorizedKeysBlockEnd+"\n" {
+		t.Fatalf("managed block should be emptied: %q", contents)
+	}
+}
+
+func TestWriteSSHKeysSkipsFailedUsers(t *testing.T) {
+	root := t.TempDir()
+
+	passwdPath := filepath.Join(root, "passwd")
+	writeTestFile(
+		t, passwdPath,
+		"alice:x:1001:1001::/home/alice:/bin/sh\n"+
+			"bob:x:1002:1002::/home/bob:/bin/sh\n",
+	)
+
+	keysDir := filepath.Join(root, "keys")
+
+	err := os.Mkdir(keysDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unterminated managed block can't be parsed, so keys of alice can't be
+	// updated.
+	writeTestFile(
+		t, filepath.Join(keysDir, "alice"), authorizedKeysBlockBegin+"\n",
+	)
+
+	transaction, err := NewTransaction(
+		filepath.Join(root, "state"), time.Second, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := mustReadSSHKey(t, testSSHKeyEd25519)
+
+	written, locations, failedUsers, err := writeSSHKeys(
+		[]string{"alice", "bob"},
+		AuthorizedKeys{"alice": SSHKeys{key}, "bob": SSHKeys{key}},
+		passwdPath, filepath.Join(keysDir, "%u"), AuthorizedKeysModeAppend,
+		nil, transaction,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(failedUsers, ",") != "alice" {
+		t.Fatalf("unexpected failed users: %v", failedUsers)
+	}
+
+	if written != 1 || len(locations) != 1 || locations[0].user != "bob" {
+		t.Fatalf("keys of bob should be written: %d %v", written, locations)
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readTestFile(t, filepath.Join(keysDir, "bob")) !=
+		testSSHKeyEd25519+"\n" {
+		t.Fatal("keys of bob should be installed")
+	}
+
+	if readTestFile(t, filepath.Join(keysDir, "alice")) !=
+		authorizedKeysBlockBegin+"\n" {
+		t.Fatal("keys file of alice should be left untouched")
+	}
+}
+
+func TestExpandAuthorizedKeysPath(t *testing.T) {
+	testcases := []struct {
+		template string
+		username string
+		home     string
+		expected string
+		valid    bool
+	}{
+		{
+			template: "/etc/ssh/authorized_keys/%u",
+			username: "john",
+			expected: "/etc/ssh/authorized_keys/john",
+			valid:    true,
+		},
+		{
+			template: "%h/.ssh/authorized_keys",
+			username: "john",
+			home:     "/home/john/",
+			expected: "/home/john/.ssh/authorized_keys",
+			valid:    true,
+		},
+		{
+			template: "/keys/%u.%%",
+			username: "john",
+			expected: "/keys/john.%",
+			valid:    true,
+		},
+		{template: "/keys/%u%", username: "john"},
+		{template: "/keys/%x", username: "john"},
+		{template: "keys/%u", username: "john"},
+		{template: "/keys/%u", username: "../root"},
+		{template: "/keys/%u", username: ".."},
+		{template: "%h/.ssh/authorized_keys", username: "john"},
+	}
+
+	for _, testcase := range testcases {
+		path, err := expandAuthorizedKeysPath(
+			testcase.template, testcase.username, testcase.home,
+		)
+
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf(
+					"%q for %q should not be expanded, got %q",
+					testcase.template, testcase.username, path,
+				)
+			}
+
+			continue
+		}
+
+		if err != nil || path != testcase.expected {
+			t.Errorf(
+				"%q for %q: expected %q, got %q, %v",
+				testcase.template, testcase.username, testcase.expected,
+				path, err,
+			)
+		}
+	}
+}
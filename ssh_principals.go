@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/reconquest/hierr-go"
+)
+
+const sshManagedFileNotice = "# managed by shadowc, do not edit"
+
+// SSHPrincipals is a list of SSH certificate principals written into
+// AuthorizedPrincipalsFile of sshd, one principal per line.
+type SSHPrincipals []string
+
+func (principals SSHPrincipals) Write(writer io.Writer) (int, error) {
+	totalWritten := 0
+
+	lines := append([]string{sshManagedFileNotice}, principals...)
+	for _, line := range lines {
+		written, err := io.WriteString(writer, line+"\n")
+		if err != nil {
+			return totalWritten, err
+		}
+
+		totalWritten += written
+	}
+
+	return totalWritten, nil
+}
+
+// getSSHPrincipals retrieves principals of specified users. If shadowd
+// servers are not aware of user principals, user has no principals, so
+// certificates are no longer accepted for that user.
+func getSSHPrincipals(
+	usernames []string, upstream *ShadowdUpstream, pool string,
+) (map[string]SSHPrincipals, error) {
+	principals := map[string]SSHPrincipals{}
+
+	for _, username := range usernames {
+		shadowdHosts, err := upstream.GetAliveShadowdHosts()
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			found    = false
+			notFound = false
+		)
+
+		for _, shadowdHost := range shadowdHosts {
+			userPrincipals, err := shadowdHost.GetSSHPrincipals(
+				pool, username,
+			)
+			if err != nil {
+				switch err.(type) {
+				case NotFoundError:
+					warningf(
+						"[%s] is not aware of ssh principals for %s",
+						shadowdHost.GetAddr(), user{username, pool},
+					)
+
+					notFound = true
+
+				default:
+					shadowdHost.SetIsAlive(false)
+
+					errorh(
+						err, "[%s] has gone away", shadowdHost.GetAddr(),
+					)
+				}
+
+				continue
+			}
+
+			found = true
+			principals[username] = userPrincipals
+			break
+		}
+
+		if !found && notFound {
+			principals[username] = SSHPrincipals{}
+		}
+	}
+
+	return principals, nil
+}
+
+// getSSHCAKeys retrieves trusted user CA keys of specified pool, nil is
+// returned if shadowd servers are not aware of CA keys.
+func getSSHCAKeys(upstream *ShadowdUpstream, pool string) (SSHKeys, error) {
+	shadowdHosts, err := upstream.GetAliveShadowdHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, shadowdHost := range shadowdHosts {
+		keys, err := shadowdHost.GetSSHCAKeys(pool)
+		if err != nil {
+			switch err.(type) {
+			case NotFoundError:
+				warningf(
+					"[%s] is not aware of ssh CA keys for pool '%s'",
+					shadowdHost.GetAddr(), pool,
+				)
+
+			default:
+				shadowdHost.SetIsAlive(false)
+
+				errorh(err, "[%s] has gone away", shadowdHost.GetAddr())
+			}
+
+			continue
+		}
+
+		return keys, nil
+	}
+
+	return nil, nil
+}
+
+// writeSSHPrincipals stages principals files of specified users, path
+// template is expanded in the same way as for authorized_keys. Failure to
+// update one user does not prevent updating others, names of users which
+// principals are not updated are returned.
+func writeSSHPrincipals(
+	usernames []string, principals map[string]SSHPrincipals,
+	passwdFilePath string, pathTemplate string, transaction *Transaction,
+) ([]string, error) {
+	homeDirs, err := getUsersHomeDirs(passwdFilePath)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err, "can't get users home directories from passwd file %s",
+			passwdFilePath,
+		)
+	}
+
+	if !strings.HasPrefix(pathTemplate, "/") {
+		pathTemplate = "%h/" + pathTemplate
+	}
+
+	isUserOwned := strings.Contains(pathTemplate, "%h")
+
+	failedUsers := []string{}
+
+	for _, user := range usernames {
+		userPrincipals, ok := principals[user]
+		if !ok {
+			continue
+		}
+
+		home, ok := homeDirs[user]
+		if !ok && isUserOwned {
+			infof("no home directory found for user %s, skipping", user)
+			continue
+		}
+
+		err := writeSSHPrincipalsFile(
+			user, userPrincipals, pathTemplate, home, isUserOwned,
+			transaction,
+		)
+		if err != nil {
+			errorh(err, "can't update ssh principals of user %s", user)
+
+			failedUsers = append(failedUsers, user)
+			continue
+		}
+
+		infof(
+			"ssh principals of user %s updated: %s",
+			user, strings.Join(userPrincipals, ", "),
+		)
+	}
+
+	return failedUsers, nil
+}
+
+func writeSSHPrincipalsFile(
+	user string, principals SSHPrincipals, pathTemplate string, home string,
+	isUserOwned bool, transaction *Transaction,
+) error {
+	path, err := expandAuthorizedKeysPath(pathTemplate, user, home)
+	if err != nil {
+		return hierr.Errorf(err, "can't get principals file path")
+	}
+
+	dir, fileMode, err := openSecureFileDirectory(
+		user, path, isUserOwned, true,
+	)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return transaction.Stage(
+		dir, filepath.Base(path), BackupKindPrincipals, fileMode,
+		principals, nil,
+	)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSSHPrincipals(t *testing.T) {
+	root := t.TempDir()
+
+	passwdPath := filepath.Join(root, "passwd")
+	writeTestFile(
+		t, passwdPath,
+		"alice:x:1001:1001::/home/alice:/bin/sh\n"+
+			"bob:x:1002:1002::/home/bob:/bin/sh\n",
+	)
+
+	principalsDir := filepath.Join(root, "principals")
+
+	err := os.Mkdir(principalsDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// directory of alice can't be opened, because it's a file, so
+	// principals of alice can't be updated.
+	writeTestFile(t, filepath.Join(principalsDir, "alice"), "")
+
+	transaction, err := NewTransaction(
+		filepath.Join(root, "state"), time.Second, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failedUsers, err := writeSSHPrincipals(
+		[]string{"alice", "bob", "carol", "dave"},
+		map[string]SSHPrincipals{
+			"alice": {"alice"},
+			"bob":   {"bob", "admins"},
+			"dave":  {},
+		},
+		passwdPath, filepath.Join(principalsDir, "%u", "principals"),
+		transaction,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(failedUsers, ",") != "alice" {
+		t.Fatalf("unexpected failed users: %v", failedUsers)
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(principalsDir, "bob", "principals")
+	if readTestFile(t, path) != sshManagedFileNotice+"\nbob\nadmins\n" {
+		t.Fatalf("unexpected principals of bob: %q", readTestFile(t, path))
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Mode().Perm() != 0644 {
+		t.Fatalf("root-owned principals file mode is %s", stat.Mode())
+	}
+
+	// user without principals should have empty file, so certificates are
+	// not accepted for that user anymore.
+	path = filepath.Join(principalsDir, "dave", "principals")
+	if readTestFile(t, path) != sshManagedFileNotice+"\n" {
+		t.Fatalf("unexpected principals of dave: %q", readTestFile(t, path))
+	}
+
+	_, err = os.Stat(filepath.Join(principalsDir, "carol"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("principals of unknown user should not be written: %v", err)
+	}
+}
+
+func TestGetSSHPrincipals(t *testing.T) {
+	var (
+		notFound = func(writer http.ResponseWriter, _ *http.Request) {
+			writer.WriteHeader(http.StatusNotFound)
+		}
+
+		failed = func(writer http.ResponseWriter, _ *http.Request) {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+
+		found = func(writer http.ResponseWriter, request *http.Request) {
+			if request.URL.Path != "/principals/production/john" {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			writer.Write([]byte("# principals\njohn\n\n  admins \n"))
+		}
+	)
+
+	testcases := []struct {
+		name       string
+		handlers   []http.HandlerFunc
+		principals map[string]SSHPrincipals
+	}{
+		{
+			"found",
+			[]http.HandlerFunc{failed, found},
+			map[string]SSHPrincipals{"john": {"john", "admins"}},
+		},
+		{
+			"not aware",
+			[]http.HandlerFunc{notFound},
+			map[string]SSHPrincipals{"john": {}},
+		},
+		{
+			"failed",
+			[]http.HandlerFunc{failed},
+			map[string]SSHPrincipals{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		principals, err := getSSHPrincipals(
+			[]string{"john"},
+			newTestShadowdUpstream(t, testcase.handlers...), "production",
+		)
+		if err != nil {
+			t.Fatalf("%s: %v", testcase.name, err)
+		}
+
+		if !reflect.DeepEqual(principals, testcase.principals) {
+			t.Errorf(
+				"%s: expected %v, got %v",
+				testcase.name, testcase.principals, principals,
+			)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/reconquest/hierr-go"
+)
+
+const stateFileName = "state.json"
+
+// State describes what shadowc has installed on the host, it is updated
+// along with installed files in the same transaction.
+type State struct {
+	UpdatedAt time.Time             `json:"updated_at"`
+	Users     map[string]*UserState `json:"users"`
+
+	path string
+}
+
+// UserState describes what shadowc has installed for a single local user.
+type UserState struct {
+	Pool      string         `json:"pool,omitempty"`
+	CreatedAt *time.Time     `json:"created_at,omitempty"`
+	Hash      *InstalledHash `json:"hash,omitempty"`
+	Keys      *InstalledKeys `json:"keys,omitempty"`
+
+	// HashHistory contains digests of the latest received hashes, which
+	// are used for detecting replayed hashes.
+	HashHistory []string `json:"hash_history,omitempty"`
+}
+
+// InstalledHash describes shadow entry hash installed by shadowc. Hash
+// itself is never stored outside of shadow file, only its digest.
+type InstalledHash struct {
+	Digest      string    `json:"digest"`
+	Server      string    `json:"server"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// InstalledKeys describes SSH keys installed by shadowc into authorized_keys
+// file of the user.
+type InstalledKeys struct {
+	Path         string    `json:"path"`
+	Fingerprints []string  `json:"fingerprints"`
+	Server       string    `json:"server"`
+	InstalledAt  time.Time `json:"installed_at"`
+}
+
+// LoadState reads state from the state directory, empty state is returned
+// if shadowc has never been run.
+func LoadState(stateDir string) (*State, error) {
+	state := &State{
+		Users: map[string]*UserState{},
+		path:  filepath.Join(stateDir, stateFileName),
+	}
+
+	data, err := ioutil.ReadFile(state.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+
+		return nil, hierr.Errorf(err, "can't read state file %s", state.path)
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err, "can't decode state file %s", state.path,
+		)
+	}
+
+	if state.Users == nil {
+		state.Users = map[string]*UserState{}
+	}
+
+	return state, nil
+}
+
+// GetUser returns state of specified user, creating it if necessary. If user
+// has been managed within another pool, the change is reported and history
+// of hashes, which were received from hash table of another pool, is reset.
+func (state *State) GetUser(username, pool string) *UserState {
+	userState, ok := state.Users[username]
+	if !ok {
+		userState = &UserState{Pool: pool}
+		state.Users[username] = userState
+	}
+
+	if userState.Pool != pool {
+		warningf(
+			"user %s has been managed within pool '%s', "+
+				"now it is managed within pool '%s'",
+			username, userState.Pool, pool,
+		)
+
+		userState.Pool = pool
+		userState.HashHistory = nil
+	}
+
+	return userState
+}
+
+// Prune removes users which are no longer managed by shadowc: users which
+// have been deleted locally and, if users are complete list of users of
+// the pool, users which have been removed from the pool.
+func (state *State) Prune(
+	pool string, usernames []string, complete bool,
+	localUsers map[string]bool,
+) {
+	managed := map[string]bool{}
+	for _, username := range usernames {
+		managed[username] = true
+	}
+
+	for username, userState := range state.Users {
+		switch {
+		case !localUsers[username]:
+			debugf("user %s is deleted, removing it from state", username)
+
+		case complete && userState.Pool == pool && !managed[username]:
+			debugf(
+				"user %s is removed from pool '%s', removing it from state",
+				username, pool,
+			)
+
+		default:
+			continue
+		}
+
+		delete(state.Users, username)
+	}
+}
+
+// ForgetFile removes records about file at specified path, which has been
+// replaced not by shadowc, e.g. restored from backup, so state does not
+// claim that its contents have been installed by shadowc.
+func (state *State) ForgetFile(path, kind string) {
+	for _, userState := range state.Users {
+		switch kind {
+		case BackupKindShadow:
+			userState.Hash = nil
+
+		case BackupKindAuthorizedKeys:
+			if userState.Keys != nil && userState.Keys.Path == path {
+				userState.Keys = nil
+			}
+		}
+	}
+}
+
+// GetUsernames returns sorted names of users known to the state.
+func (state *State) GetUsernames() []string {
+	usernames := []string{}
+	for username := range state.Users {
+		usernames = append(usernames, username)
+	}
+
+	sort.Strings(usernames)
+
+	return usernames
+}
+
+// IsHashSeen reports whether specified hash has been received for the user
+// before.
+func (state *State) IsHashSeen(username, hash string) bool {
+	userState, ok := state.Users[username]
+	if !ok {
+		return false
+	}
+
+	digest := getDigest([]byte(hash))
+	for _, seen := range userState.HashHistory {
+		if seen == digest {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RememberHash adds hash to the history of received hashes, only the latest
+// hashes are kept.
+func (userState *UserState) RememberHash(hash string) {
+	digest := getDigest([]byte(hash))
+	for _, seen := range userState.HashHistory {
+		if seen == digest {
+			return
+		}
+	}
+
+	history := append(userState.HashHistory, digest)
+	if len(history) > hashHistorySize {
+		history = history[len(history)-hashHistorySize:]
+	}
+
+	userState.HashHistory = history
+}
+
+// SetCreated records that user has been created by shadowc.
+func (userState *UserState) SetCreated(now time.Time) {
+	userState.CreatedAt = &now
+}
+
+// SetHash records installed hash, time of installation is kept if the same
+// hash was already installed.
+func (userState *UserState) SetHash(hash, server string, now time.Time) {
+	digest := getDigest([]byte(hash))
+	if userState.Hash != nil && userState.Hash.Digest == digest {
+		return
+	}
+
+	userState.Hash = &InstalledHash{
+		Digest:      digest,
+		Server:      server,
+		InstalledAt: now,
+	}
+}
+
+// SetKeys records keys installed into authorized_keys file at specified
+// path, time of installation is kept if the same keys were already
+// installed.
+func (userState *UserState) SetKeys(
+	path string, keys SSHKeys, server string, now time.Time,
+) {
+	fingerprints := []string{}
+	for _, key := range keys {
+		fingerprints = append(fingerprints, key.GetFingerprint())
+	}
+
+	sort.Strings(fingerprints)
+
+	if userState.Keys != nil && userState.Keys.Path == path &&
+		isStringsEqual(userState.Keys.Fingerprints, fingerprints) {
+		return
+	}
+
+	userState.Keys = &InstalledKeys{
+		Path:         path,
+		Fingerprints: fingerprints,
+		Server:       server,
+		InstalledAt:  now,
+	}
+}
+
+// Stage stages new version of the state file into the transaction.
+func (state *State) Stage(transaction *Transaction, now time.Time) error {
+	state.UpdatedAt = now
+
+	dir, err := OpenSecureDirectory(filepath.Dir(state.path), 0, 0, 0700)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return transaction.Stage(
+		dir, filepath.Base(state.path), BackupKindState, 0600, state, nil,
+	)
+}
+
+func (state *State) Write(writer io.Writer) (int, error) {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	return writer.Write(append(data, '\n'))
+}
+
+func isStringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateGetUserPoolChange(t *testing.T) {
+	state, err := LoadState(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state.GetUser("john", "production").RememberHash("$6$hash")
+
+	userState := state.GetUser("john", "production")
+	if userState.Pool != "production" || len(userState.HashHistory) != 1 {
+		t.Fatal("user state should be kept within the same pool")
+	}
+
+	userState = state.GetUser("john", "staging")
+	if userState.Pool != "staging" {
+		t.Fatalf("pool should be changed, got %q", userState.Pool)
+	}
+
+	if len(userState.HashHistory) != 0 {
+		t.Fatal("hash history of another pool should be reset")
+	}
+}
+
+func TestStatePrune(t *testing.T) {
+	state, err := LoadState(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"john", "bob", "deleted"} {
+		state.GetUser(username, "production")
+	}
+
+	state.GetUser("alice", "staging")
+
+	localUsers := map[string]bool{"john": true, "bob": true, "alice": true}
+
+	state.Prune("production", []string{"john"}, false, localUsers)
+
+	if len(state.GetUsernames()) != 3 || state.Users["deleted"] != nil {
+		t.Fatalf("only deleted user should be pruned: %q", state.GetUsernames())
+	}
+
+	state.Prune("production", []string{"john"}, true, localUsers)
+
+	usernames := state.GetUsernames()
+	if len(usernames) != 2 || usernames[0] != "alice" || usernames[1] != "john" {
+		t.Fatalf("user removed from pool should be pruned: %q", usernames)
+	}
+}
+
+func TestStateStage(t *testing.T) {
+	root := t.TempDir()
+	stateDir := filepath.Join(root, "state")
+
+	state, err := LoadState(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	userState := state.GetUser("john", "production")
+	userState.SetHash("$6$hash", "shadowd-1", now)
+	userState.SetKeys(
+		"/home/john/.ssh/authorized_keys",
+		SSHKeys{mustReadSSHKey(t, testSSHKeyEd25519)}, "shadowd-1", now,
+	)
+
+	transaction, err := NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = state.Stage(transaction, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadState(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedUser := loaded.Users["john"]
+	if loadedUser == nil || loadedUser.Hash == nil || loadedUser.Keys == nil {
+		t.Fatal("state should be loaded back")
+	}
+
+	if loadedUser.Hash.Digest != getDigest([]byte("$6$hash")) {
+		t.Fatal("digest of hash should be stored")
+	}
+
+	transaction, err = NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = updateStateAfterRollback(
+		stateDir,
+		&Backup{Files: []BackupFile{
+			{Path: "/etc/shadow", Kind: BackupKindShadow},
+			{
+				Path: "/home/john/.ssh/authorized_keys",
+				Kind: BackupKindAuthorizedKeys,
+			},
+		}},
+		transaction,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err = LoadState(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Users["john"].Hash != nil || loaded.Users["john"].Keys != nil {
+		t.Fatal("records about restored files should be removed")
+	}
+}
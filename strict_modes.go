@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reconquest/hierr-go"
+)
+
+// checkStrictModes verifies that authorized_keys file at specified path and
+// directories containing it satisfy sshd StrictModes requirements: each of
+// them should be owned either by root or by the user and should not be
+// writable by group or others, otherwise sshd silently ignores the file.
+// Directories are checked up to the user home directory or up to / if file
+// is located outside of home directory, like sshd does.
+//
+// Files and directories owned by root are accepted for any user, like sshd
+// does, so uid of root can be specified for files which are written outside
+// of home directories. Missing directories are never created.
+//
+// If repair is true, group and others write permissions are removed.
+// Problems which are left unrepaired are returned.
+func checkStrictModes(
+	path, home string, uid, gid int, repair bool,
+) ([]string, error) {
+	dir, err := OpenExistingSecureDirectory(filepath.Dir(path), uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		dir.Close()
+	}()
+
+	file, err := dir.OpenFile(filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't stat %s", path)
+	}
+
+	problems := []string{}
+
+	problem, err := fixWritableMode(path, stat.Mode(), file.Chmod, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem != "" {
+		problems = append(problems, problem)
+	}
+
+	stopAt := "/"
+	if home != "" && strings.HasPrefix(path, filepath.Clean(home)+"/") {
+		homeDir, err := OpenExistingSecureDirectory(home, uid, gid)
+		if err != nil {
+			return nil, err
+		}
+
+		// home directory can be a symlink owned by root, directories are
+		// compared by resolved paths.
+		stopAt = homeDir.GetPath()
+		homeDir.Close()
+	}
+
+	for {
+		dirStat, err := dir.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		problem, err := fixWritableMode(
+			dir.GetPath(), getUnixFileMode(dirStat.Mode), dir.Chmod, repair,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+
+		if dir.GetPath() == stopAt || dir.GetPath() == "/" {
+			break
+		}
+
+		parent, err := OpenExistingSecureDirectory(
+			filepath.Dir(dir.GetPath()), uid, gid,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		dir.Close()
+		dir = parent
+	}
+
+	return problems, nil
+}
+
+// fixWritableMode returns description of the problem if specified mode
+// allows group or others to write, or removes these permissions using chmod
+// if repair is true. Setuid, setgid and sticky bits are preserved.
+func fixWritableMode(
+	path string, mode os.FileMode, chmod func(os.FileMode) error,
+	repair bool,
+) (string, error) {
+	if mode.Perm()&0022 == 0 {
+		return "", nil
+	}
+
+	if !repair {
+		return fmt.Sprintf(
+			"%s is writable by group or others (mode %#o)",
+			path, mode.Perm(),
+		), nil
+	}
+
+	err := chmod(mode & fileModeBits &^ 0022)
+	if err != nil {
+		return "", hierr.Errorf(
+			err, "can't remove group and others write permissions from %s",
+			path,
+		)
+	}
+
+	infof(
+		"removed group and others write permissions from %s (mode %#o)",
+		path, mode.Perm(),
+	)
+
+	return "", nil
+}
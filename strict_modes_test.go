@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixWritableModeKeepsSpecialBits(t *testing.T) {
+	var changed os.FileMode
+
+	chmod := func(mode os.FileMode) error {
+		changed = mode
+		return nil
+	}
+
+	_, err := fixWritableMode(
+		"/dir", os.ModeDir|os.ModeSetgid|os.ModeSticky|0777, chmod, true,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed != os.ModeSetgid|os.ModeSticky|0755 {
+		t.Fatalf("unexpected mode %s", changed)
+	}
+}
+
+func TestCheckStrictModesRepair(t *testing.T) {
+	home := t.TempDir()
+
+	dir := filepath.Join(home, ".ssh")
+
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mode is set explicitly, because umask is applied to Mkdir.
+	err = os.Chmod(dir, os.ModeSetgid|0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "authorized_keys")
+
+	err = ioutil.WriteFile(path, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chmod(path, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := checkStrictModes(
+		path, home, os.Getuid(), os.Getgid(), false,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 2 {
+		t.Fatalf("expected problems with file and directory: %q", problems)
+	}
+
+	problems, err = checkStrictModes(
+		path, home, os.Getuid(), os.Getgid(), true,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 0 {
+		t.Fatalf("problems should be repaired: %q", problems)
+	}
+
+	stat, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Mode()&fileModeBits != os.ModeSetgid|0755 {
+		t.Fatalf("unexpected directory mode %s", stat.Mode())
+	}
+
+	stat, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected file mode %s", stat.Mode())
+	}
+}
+
+func TestStrictModesOfRootOwnedLocation(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("creating root-owned files requires root")
+	}
+
+	root := t.TempDir()
+
+	dir := filepath.Join(root, "etc", "ssh", "authorized_keys")
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "deploy")
+
+	err = ioutil.WriteFile(path, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// user is not looked up for files outside of home directory, so it
+	// doesn't need to exist.
+	location := authorizedKeysLocation{
+		user:        "shadowc-test-missing-user",
+		path:        path,
+		home:        root,
+		isUserOwned: false,
+	}
+
+	if !isStrictModesSatisfied(location, false) {
+		t.Fatal("root-owned file should be accepted")
+	}
+
+	problems, err := checkStrictModes(path, root, 65534, 65534, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 0 {
+		t.Fatalf("root-owned file should be accepted: %q", problems)
+	}
+}
@@ -4,18 +4,26 @@ tests:clone shadowd.mock bin/
 tests:ensure chmod +x bin/shadowd.mock
 
 _shadowd="localhost:64777"
+_shadowd_another="localhost:64778"
 
+# :shadowd [<address>] starts shadowd mock, additional servers can be started
+# by specifying address.
 :shadowd() {
+    local address=${1:-$_shadowd}
+
     tests:value _blankd \
         $(which blankd) \
-        -l "$_shadowd" \
+        -l "$address" \
         --tls \
-        -o $(tests:get-tmp-dir)/blankd.log \
+        -o $(tests:get-tmp-dir)/blankd${1:+_${address##*:}}.log \
         -d $(tests:get-tmp-dir)/ \
         -e $(tests:get-tmp-dir)/bin/shadowd.mock
-    tests:put-string _blankd_process "$_blankd"
+    tests:put-string _blankd_process${1:+_${address##*:}} "$_blankd"
 }
 
+# :shadowd-set-response [<port>_<n>] sets response of shadowd mock, responses
+# with port are returned only by server listening on that port in order of
+# <n>.
 :shadowd-set-response() {
     tests:put shadowd_response${1:+_$1}
 }
@@ -1,7 +1,11 @@
-if [[ -f _blankd_process ]]; then
-    tests:eval kill -9 "$(cat _blankd_process)"
-fi
+for process in _blankd_process*; do
+    if [[ -f $process ]]; then
+        tests:eval kill -9 "$(cat $process)"
+    fi
+done
 
-if [[ -f $(tests:get-tmp-dir)/blankd.log ]]; then
-    cat $(tests:get-tmp-dir)/blankd.log
-fi
+for log in $(tests:get-tmp-dir)/blankd*.log; do
+    if [[ -f $log ]]; then
+        cat $log
+    fi
+done
@@ -0,0 +1,96 @@
+:shadowd
+:shadowd "$_shadowd_another"
+
+:shadowd-set-response 64777_1 <<OUT
+200
+
+\$5\$abcdef
+\$5\$123456
+OUT
+
+:shadowd-set-response 64778_1 <<OUT
+200
+
+\$5\$ghijkl
+\$5\$789012
+OUT
+
+:shadowd-set-response 64778_2 <<OUT
+500
+
+OUT
+
+oldpassword="old-password"
+
+tests:not tests:ensure expect <<EXPECT
+  set timeout -1
+  spawn sh -c "shadowc.test -c tls.crt -P -G --password-style passphrase --password-length 4 --all-servers --password-fd 3 -s $_shadowd -s $_shadowd_another -p ops -u operator 3>generated"
+  expect {
+    Password: {
+        send "$oldpassword\r"
+        exp_continue
+    } eof {
+        send_error "\$expect_out(buffer)"
+        catch wait result
+        exit [lindex \$result 3]
+    }
+  }
+EXPECT
+
+tests:assert-stderr-re "salts for user operator within pool ops on \[$_shadowd_another\] differ"
+tests:assert-stderr-re "changed only on 1 of 2 shadowd servers"
+tests:assert-stderr-re "quorum of 2 servers is not reached"
+
+# generated password is accepted by one of servers, so it is printed even
+# though quorum is not reached.
+tests:ensure test -s generated
+
+password=$(cat generated)
+
+tests:ensure grep -q "^password=$password&shadow%5B%5D=%245%24abcdef%24" \
+    shadowd_request_64777/body/raw
+tests:ensure grep -q "^password=$password&shadow%5B%5D=%245%24ghijkl%24" \
+    shadowd_request_64778/body/raw
+
+:shadowd-set-response 64777_1 <<OUT
+200
+
+\$5\$abcdef
+\$5\$123456
+OUT
+
+:shadowd-set-response 64778_1 <<OUT
+200
+
+\$5\$abcdef
+\$5\$123456
+OUT
+
+:shadowd-set-response 64778_2 <<OUT
+500
+
+OUT
+
+tests:ensure expect <<EXPECT
+  set timeout -1
+  spawn shadowc.test -c tls.crt -P --all-servers --quorum 1 -s $_shadowd -s $_shadowd_another -p ops -u operator
+  expect {
+    Password: {
+        send "$oldpassword\r"
+        exp_continue
+    } "New password:" {
+        send "new-password\r"
+        exp_continue
+    } "Repeat new password:" {
+        send "new-password\r"
+        exp_continue
+    } eof {
+        send_error "\$expect_out(buffer)"
+        catch wait result
+        exit [lindex \$result 3]
+    }
+  }
+EXPECT
+
+# quorum of one server is reached, but partial change is still reported.
+tests:assert-stderr-re "changed only on 1 of 2 shadowd servers"
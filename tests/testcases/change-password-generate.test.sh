@@ -0,0 +1,35 @@
+:shadowd
+
+:shadowd-set-response <<OUT
+200
+
+\$5\$abcdef
+\$5\$123456
+OUT
+
+oldpassword="old-password"
+
+tests:ensure expect <<EXPECT
+  set timeout -1
+  spawn sh -c "shadowc.test --trace -c tls.crt -P -G --password-style passphrase --password-length 4 --password-fd 3 -s $_shadowd -p ops -u operator 3>generated"
+  expect {
+    Password: {
+        send "$oldpassword\r"
+        exp_continue
+    } eof {
+        send_error "\$expect_out(buffer)"
+        exit 0
+    }
+  }
+EXPECT
+
+tests:ensure grep -qE '^([a-z]{6}-){3}[a-z]{6}$' generated
+
+password=$(cat generated)
+
+shadow1="%245%24abcdef%24"
+shadow2="%245%24123456%24"
+
+tests:ensure grep -q "^password=$password&shadow%5B%5D=$shadow1" \
+    shadowd_request/body/raw
+tests:ensure grep -q "&shadow%5B%5D=$shadow2" shadowd_request/body/raw
@@ -0,0 +1,51 @@
+:shadowd
+
+:shadowd-set-response <<OUT
+200
+
+\$5\$abcdef
+\$5\$123456
+OUT
+
+password="new-password"
+hash='$5$abcdef$ly9hxeVhNT8/FKppVb3faXkQd8lx/o/96JZtM2p5UJ0'
+
+tests:put shadow <<SHADOW
+root:!:17000:0:99999:7:::
+operator:$hash:17000:0:99999:7:::
+SHADOW
+
+tests:ensure expect <<EXPECT
+  set timeout -1
+  spawn shadowc.test -c tls.crt -f shadow check --remote -s $_shadowd -p ops -u operator
+  expect {
+    Password: {
+        send "$password\r"
+        exp_continue
+    } eof {
+        send_error "\$expect_out(buffer)"
+        catch wait result
+        exit [lindex \$result 3]
+    }
+  }
+EXPECT
+
+tests:assert-stderr-re "matches shadow entry of user operator"
+tests:assert-stderr-re "generated from the current hash table"
+
+tests:not tests:ensure expect <<EXPECT
+  set timeout -1
+  spawn shadowc.test -c tls.crt -f shadow check -u operator
+  expect {
+    Password: {
+        send "wrong-password\r"
+        exp_continue
+    } eof {
+        send_error "\$expect_out(buffer)"
+        catch wait result
+        exit [lindex \$result 3]
+    }
+  }
+EXPECT
+
+tests:assert-stderr-re "does not match shadow entry of user operator"
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/reconquest/hierr-go"
+
+	"golang.org/x/sys/unix"
+)
+
+const transactionJournalName = "transaction.journal"
+
+// TransactionFile is a file which is staged as temporary file in the same
+// directory and replaces the file at Path when transaction is committed.
+type TransactionFile struct {
+	Path      string `json:"path"`
+	Temporary string `json:"temporary"`
+	Kind      string `json:"kind"`
+	UID       int    `json:"uid"`
+	GID       int    `json:"gid"`
+
+	// Original is a digest of the replaced file, it is empty if file did
+	// not exist. File which has been changed by somebody else after it was
+	// staged is not replaced.
+	Original string `json:"original"`
+
+	// Staged is a digest of the temporary file contents.
+	Staged string `json:"staged"`
+}
+
+// transactionRecord is a single line of the journal, which describes either
+// staged file, created user or the commit itself.
+type transactionRecord struct {
+	File   *TransactionFile `json:"file,omitempty"`
+	User   string           `json:"user,omitempty"`
+	Commit bool             `json:"commit,omitempty"`
+}
+
+// Transaction collects all changes of one run, so either all of them are
+// installed or none. Every file is written into temporary file first and
+// all temporary files are renamed only when every change is prepared.
+// Progress is recorded into journal in the state directory, so transaction
+// interrupted by crash is completed if it was committed or rolled back
+// otherwise on the next start of shadowc.
+type Transaction struct {
+	journalPath string
+	journal     *os.File
+
+	files []*TransactionFile
+	users []string
+
+	lockTimeout time.Duration
+	shadowLock  *ShadowLock
+
+	backup      *Backup
+	backupKinds map[string]bool
+
+	committing bool
+}
+
+// NewTransaction starts new transaction, files of specified kinds are saved
+// into the backup before they are replaced, if backup is not nil.
+func NewTransaction(
+	stateDir string, lockTimeout time.Duration,
+	backup *Backup, backupKinds ...string,
+) (*Transaction, error) {
+	err := os.MkdirAll(stateDir, 0700)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err, "can't create state directory %s", stateDir,
+		)
+	}
+
+	path := filepath.Join(stateDir, transactionJournalName)
+
+	journal, err := os.OpenFile(
+		path,
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND|unix.O_NOFOLLOW,
+		0600,
+	)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf(
+				"journal of unfinished transaction %s already exists", path,
+			)
+		}
+
+		return nil, hierr.Errorf(err, "can't create journal %s", path)
+	}
+
+	transaction := &Transaction{
+		journalPath: path,
+		journal:     journal,
+		lockTimeout: lockTimeout,
+		backup:      backup,
+		backupKinds: map[string]bool{},
+	}
+
+	for _, kind := range backupKinds {
+		transaction.backupKinds[kind] = true
+	}
+
+	return transaction, nil
+}
+
+// RecoverTransaction finishes transaction which has been interrupted: it is
+// completed if it had been committed or rolled back otherwise.
+func RecoverTransaction(stateDir string, lockTimeout time.Duration) error {
+	path := filepath.Join(stateDir, transactionJournalName)
+
+	transaction, committed, err := readTransactionJournal(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return hierr.Errorf(err, "can't read journal %s", path)
+	}
+
+	transaction.lockTimeout = lockTimeout
+
+	if committed {
+		warningf(
+			"completing interrupted transaction, %d files left to install",
+			len(transaction.files),
+		)
+
+		err = transaction.install()
+		transaction.unlockShadowFile()
+		if err != nil {
+			return hierr.Errorf(err, "can't complete interrupted transaction")
+		}
+	} else {
+		warningf(
+			"rolling back interrupted transaction, %d files and %d users "+
+				"were prepared",
+			len(transaction.files), len(transaction.users),
+		)
+
+		transaction.rollback()
+	}
+
+	return transaction.removeJournal()
+}
+
+func readTransactionJournal(path string) (*Transaction, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	transaction := &Transaction{journalPath: path}
+	committed := false
+
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	for number, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		var record transactionRecord
+
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			// last record can be written partially if shadowc has been
+			// killed while writing it.
+			if number == len(lines)-1 {
+				warningf("ignoring truncated last record of journal %s", path)
+				break
+			}
+
+			return nil, false, hierr.Errorf(
+				err, "can't decode record #%d", number+1,
+			)
+		}
+
+		switch {
+		case record.File != nil:
+			transaction.files = append(transaction.files, record.File)
+
+		case record.User != "":
+			transaction.users = append(transaction.users, record.User)
+
+		case record.Commit:
+			committed = true
+		}
+	}
+
+	return transaction, committed, nil
+}
+
+// LockShadowFile acquires shadow-utils lock of specified shadow file, lock
+// is held until transaction is finished, so shadow file can't be changed
+// by others between reading it and installing its new version.
+func (transaction *Transaction) LockShadowFile(path string) error {
+	if transaction.shadowLock != nil {
+		return nil
+	}
+
+	debugf("locking shadow file %s", path)
+
+	lock, err := LockShadowFile(path, transaction.lockTimeout)
+	if err != nil {
+		return err
+	}
+
+	transaction.shadowLock = lock
+
+	return nil
+}
+
+func (transaction *Transaction) unlockShadowFile() {
+	if transaction.shadowLock != nil {
+		transaction.shadowLock.Unlock()
+		transaction.shadowLock = nil
+	}
+}
+
+// CreateUser runs useradd for specified user. Created users are recorded
+// into the journal, but are kept if transaction is rolled back.
+func (transaction *Transaction) CreateUser(name, useraddArgs string) error {
+	err := createUser(name, useraddArgs)
+	if err != nil {
+		return err
+	}
+
+	transaction.users = append(transaction.users, name)
+
+	return transaction.record(transactionRecord{User: name})
+}
+
+// stagedContents is contents of the file which is staged as is.
+type stagedContents []byte
+
+func (contents stagedContents) Write(writer io.Writer) (int, error) {
+	return writer.Write(contents)
+}
+
+// Stage writes contents into temporary file in the directory, which will
+// replace file with specified name on commit. Temporary file is read back
+// and passed to validate function, if it is not nil.
+func (transaction *Transaction) Stage(
+	dir *SecureDirectory, name string, kind string, mode os.FileMode,
+	contents interface {
+		Write(io.Writer) (int, error)
+	},
+	validate func([]byte) error,
+) error {
+	return transaction.stage(dir, name, kind, mode, contents, validate, nil)
+}
+
+// StageCopy stages contents of the source file along with its mode, owner
+// and security attributes, which will replace file with specified name on
+// commit.
+func (transaction *Transaction) StageCopy(
+	dir *SecureDirectory, name string, kind string, source *os.File,
+) error {
+	contents, err := ioutil.ReadAll(source)
+	if err != nil {
+		return hierr.Errorf(err, "can't read %s", source.Name())
+	}
+
+	return transaction.stage(
+		dir, name, kind, 0600, stagedContents(contents), nil, source,
+	)
+}
+
+// stage writes contents into temporary file, attributes of the temporary
+// file are copied from specified file, or from the original file for shadow
+// file, if it is nil.
+func (transaction *Transaction) stage(
+	dir *SecureDirectory, name string, kind string, mode os.FileMode,
+	contents interface {
+		Write(io.Writer) (int, error)
+	},
+	validate func([]byte) error,
+	attributes *os.File,
+) error {
+	path := filepath.Join(dir.GetPath(), name)
+
+	buffer := &bytes.Buffer{}
+
+	_, err := contents.Write(buffer)
+	if err != nil {
+		return hierr.Errorf(err, "can't prepare contents of %s", path)
+	}
+
+	original, err := dir.OpenFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return hierr.Errorf(err, "can't open %s", path)
+	}
+
+	originalDigest := ""
+	if original != nil {
+		defer original.Close()
+
+		originalDigest, err = getFileDigest(original)
+		if err != nil {
+			return hierr.Errorf(err, "can't read %s", path)
+		}
+
+		if transaction.shouldBackup(kind, originalDigest, buffer.Bytes()) {
+			err = transaction.backup.Add(path, kind, original)
+			if err != nil {
+				return hierr.Errorf(err, "can't backup %s", path)
+			}
+		}
+	}
+
+	temporaryFile, err := dir.CreateTempFile(name, mode)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't create temporary file at %s", dir.GetPath(),
+		)
+	}
+	defer temporaryFile.Close()
+
+	uid, gid := dir.GetOwner()
+
+	file := &TransactionFile{
+		Path:      path,
+		Temporary: filepath.Base(temporaryFile.Name()),
+		Kind:      kind,
+		UID:       uid,
+		GID:       gid,
+		Original:  originalDigest,
+		Staged:    getDigest(buffer.Bytes()),
+	}
+
+	// temporary file is recorded before it is written, so it is removed
+	// on rollback even if writing fails.
+	transaction.files = append(transaction.files, file)
+
+	err = transaction.record(transactionRecord{File: file})
+	if err != nil {
+		return err
+	}
+
+	// shadow file is often readable by group 'shadow' and should keep its
+	// SELinux label for unix_chkpwd.
+	if attributes == nil && kind == BackupKindShadow && original != nil {
+		attributes = original
+	}
+
+	if attributes != nil {
+		err = copyFileAttributes(attributes, temporaryFile)
+		if err != nil {
+			return hierr.Errorf(err, "can't copy attributes of %s", path)
+		}
+	}
+
+	_, err = temporaryFile.Write(buffer.Bytes())
+	if err == nil {
+		err = temporaryFile.Sync()
+	}
+	if err == nil {
+		err = temporaryFile.Close()
+	}
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't write temporary file %s", temporaryFile.Name(),
+		)
+	}
+
+	staged, err := readSecureFile(dir, file.Temporary)
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't read temporary file %s", temporaryFile.Name(),
+		)
+	}
+
+	if getDigest(staged) != file.Staged {
+		return fmt.Errorf(
+			"temporary file %s differs from prepared contents of %s",
+			temporaryFile.Name(), path,
+		)
+	}
+
+	if validate != nil {
+		err = validate(staged)
+		if err != nil {
+			return hierr.Errorf(err, "prepared contents of %s are invalid", path)
+		}
+	}
+
+	debugf("%s staged as %s", path, temporaryFile.Name())
+
+	return nil
+}
+
+// shouldBackup reports whether original file should be saved into backup
+// before it is replaced with specified contents. Files which are not
+// changed are not saved, so backups are made only by runs which change
+// something and older backups are not rotated out by runs which don't.
+// State file is changed on every run, so it is saved only along with other
+// files.
+func (transaction *Transaction) shouldBackup(
+	kind string, originalDigest string, contents []byte,
+) bool {
+	if transaction.backup == nil || !transaction.backupKinds[kind] {
+		return false
+	}
+
+	if originalDigest == getDigest(contents) {
+		return false
+	}
+
+	if kind == BackupKindState && len(transaction.backup.Files) == 0 {
+		return false
+	}
+
+	return true
+}
+
+// Commit installs all staged files. Shadow file is installed first and
+// other files are installed in order they were staged. If commit is
+// interrupted, remaining files are installed on the next start.
+func (transaction *Transaction) Commit() error {
+	err := transaction.record(transactionRecord{Commit: true})
+	if err != nil {
+		return err
+	}
+
+	transaction.committing = true
+
+	err = transaction.install()
+	transaction.unlockShadowFile()
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't install staged files, installation will be "+
+				"completed on the next start",
+		)
+	}
+
+	return transaction.removeJournal()
+}
+
+// Abort rolls back transaction which has not been committed: temporary
+// files are removed and created users are reported. It does nothing after
+// commit, so it can be deferred.
+func (transaction *Transaction) Abort() {
+	if transaction.committing {
+		return
+	}
+
+	transaction.unlockShadowFile()
+
+	transaction.rollback()
+
+	err := transaction.removeJournal()
+	if err != nil {
+		errorln(err)
+	}
+}
+
+func (transaction *Transaction) install() error {
+	ordered := []*TransactionFile{}
+	for _, file := range transaction.files {
+		if file.Kind == BackupKindShadow {
+			ordered = append(ordered, file)
+		}
+	}
+
+	for _, file := range transaction.files {
+		if file.Kind != BackupKindShadow {
+			ordered = append(ordered, file)
+		}
+	}
+
+	for _, file := range ordered {
+		if file.Kind == BackupKindShadow {
+			err := transaction.LockShadowFile(file.Path)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := file.install()
+		if err != nil {
+			return hierr.Errorf(err, "can't install %s", file.Path)
+		}
+	}
+
+	return nil
+}
+
+func (transaction *Transaction) rollback() {
+	for _, file := range transaction.files {
+		err := file.discard()
+		if err != nil {
+			warningh(
+				err, "can't remove temporary file %s of %s",
+				file.Temporary, file.Path,
+			)
+		}
+	}
+
+	// users are not removed: files could have been already created on
+	// behalf of them, and new user has locked password until it gets
+	// shadow entry anyway.
+	for _, user := range transaction.users {
+		warningf(
+			"user %s has been created, but other changes are not "+
+				"installed, keeping the user",
+			user,
+		)
+	}
+}
+
+// record appends record to the journal and flushes it to the disk.
+func (transaction *Transaction) record(record transactionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return hierr.Errorf(err, "can't encode journal record")
+	}
+
+	_, err = transaction.journal.Write(append(data, '\n'))
+	if err == nil {
+		err = transaction.journal.Sync()
+	}
+	if err != nil {
+		return hierr.Errorf(
+			err, "can't write journal %s", transaction.journalPath,
+		)
+	}
+
+	return nil
+}
+
+func (transaction *Transaction) removeJournal() error {
+	if transaction.journal != nil {
+		transaction.journal.Close()
+	}
+
+	err := os.Remove(transaction.journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return hierr.Errorf(
+			err, "can't remove journal %s", transaction.journalPath,
+		)
+	}
+
+	return syncDirectory(transaction.journalPath)
+}
+
+// install renames temporary file over the target file. Temporary file
+// which is missing has already been installed.
+func (file *TransactionFile) install() error {
+	dir, err := OpenSecureDirectory(
+		filepath.Dir(file.Path), file.UID, file.GID, 0700,
+	)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	staged, err := readSecureFile(dir, file.Temporary)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if getDigest(staged) != file.Staged {
+		dir.Remove(file.Temporary)
+
+		return fmt.Errorf(
+			"temporary file %s has been changed after it was staged",
+			file.Temporary,
+		)
+	}
+
+	name := filepath.Base(file.Path)
+
+	currentDigest := ""
+
+	current, err := readSecureFile(dir, name)
+	switch {
+	case err == nil:
+		currentDigest = getDigest(current)
+
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	if currentDigest != file.Original {
+		dir.Remove(file.Temporary)
+
+		warningf(
+			"%s has been changed after changes were prepared, "+
+				"leaving it untouched",
+			file.Path,
+		)
+
+		return nil
+	}
+
+	// previous version of shadow file is saved as <shadow>- like
+	// shadow-utils do, only when it is actually replaced.
+	if file.Kind == BackupKindShadow && currentDigest != "" &&
+		currentDigest != file.Staged {
+		err = saveFilePreviousVersion(dir, name)
+		if err != nil {
+			return hierr.Errorf(
+				err, "can't save previous version of %s", file.Path,
+			)
+		}
+	}
+
+	err = dir.Rename(file.Temporary, name)
+	if err != nil {
+		return hierr.Errorf(err, "can't rename %s", file.Temporary)
+	}
+
+	return dir.Sync()
+}
+
+// saveFilePreviousVersion copies file with specified name in the directory
+// into <name>- file along with its attributes.
+func saveFilePreviousVersion(dir *SecureDirectory, name string) error {
+	current, err := dir.OpenFile(name)
+	if err != nil {
+		return err
+	}
+	defer current.Close()
+
+	return installFileCopy(current, filepath.Join(dir.GetPath(), name+"-"))
+}
+
+// discard removes temporary file, if it still exists.
+func (file *TransactionFile) discard() error {
+	dir, err := OpenSecureDirectory(
+		filepath.Dir(file.Path), file.UID, file.GID, 0700,
+	)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	err = dir.Remove(file.Temporary)
+	if err != nil && err != unix.ENOENT {
+		return err
+	}
+
+	return nil
+}
+
+// readSecureFile reads whole file with specified name in the directory
+// without following symlinks.
+func readSecureFile(dir *SecureDirectory, name string) ([]byte, error) {
+	file, err := dir.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+func getFileDigest(file *os.File) (string, error) {
+	hash := sha256.New()
+
+	_, err := io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func getDigest(data []byte) string {
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getTemporaryFiles(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names
+}
+
+func TestTransactionCommit(t *testing.T) {
+	root := t.TempDir()
+	stateDir := filepath.Join(root, "state")
+
+	writeTestFile(t, filepath.Join(root, "a"), "old a\n")
+
+	transaction, err := NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stageTestFile(
+		t, transaction, filepath.Join(root, "a"), BackupKindSSHKeys, "new a\n",
+	)
+	stageTestFile(
+		t, transaction, filepath.Join(root, "b"), BackupKindSSHKeys, "new b\n",
+	)
+
+	if readTestFile(t, filepath.Join(root, "a")) != "old a\n" {
+		t.Fatal("staged file should not be installed before commit")
+	}
+
+	_, err = NewTransaction(stateDir, time.Second, nil)
+	if err == nil {
+		t.Fatal("second transaction should not be started")
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readTestFile(t, filepath.Join(root, "a")) != "new a\n" ||
+		readTestFile(t, filepath.Join(root, "b")) != "new b\n" {
+		t.Fatal("staged files should be installed")
+	}
+
+	_, err = os.Stat(filepath.Join(stateDir, transactionJournalName))
+	if !os.IsNotExist(err) {
+		t.Fatal("journal should be removed after commit")
+	}
+
+	// deferred abort does nothing after commit.
+	transaction.Abort()
+
+	if readTestFile(t, filepath.Join(root, "a")) != "new a\n" {
+		t.Fatal("abort after commit should not change anything")
+	}
+}
+
+func TestTransactionAbort(t *testing.T) {
+	root := t.TempDir()
+	stateDir := filepath.Join(root, "state")
+
+	writeTestFile(t, filepath.Join(root, "a"), "old a\n")
+
+	transaction, err := NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stageTestFile(
+		t, transaction, filepath.Join(root, "a"), BackupKindSSHKeys, "new a\n",
+	)
+
+	err = transaction.record(transactionRecord{User: "john"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction.Abort()
+
+	if readTestFile(t, filepath.Join(root, "a")) != "old a\n" {
+		t.Fatal("original file should be kept")
+	}
+
+	if temporary := getTemporaryFiles(t, root); len(temporary) != 0 {
+		t.Fatalf("temporary files should be removed: %q", temporary)
+	}
+
+	_, err = os.Stat(filepath.Join(stateDir, transactionJournalName))
+	if !os.IsNotExist(err) {
+		t.Fatal("journal should be removed after abort")
+	}
+}
+
+func TestTransactionInstallSkipsChangedFile(t *testing.T) {
+	root := t.TempDir()
+	stateDir := filepath.Join(root, "state")
+
+	writeTestFile(t, filepath.Join(root, "a"), "old a\n")
+
+	transaction, err := NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stageTestFile(
+		t, transaction, filepath.Join(root, "a"), BackupKindSSHKeys, "new a\n",
+	)
+
+	writeTestFile(t, filepath.Join(root, "a"), "changed a\n")
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readTestFile(t, filepath.Join(root, "a")) != "changed a\n" {
+		t.Fatal("file changed after staging should be left untouched")
+	}
+
+	if temporary := getTemporaryFiles(t, root); len(temporary) != 0 {
+		t.Fatalf("temporary files should be removed: %q", temporary)
+	}
+}
+
+func TestRecoverTransaction(t *testing.T) {
+	root := t.TempDir()
+	stateDir := filepath.Join(root, "state")
+
+	writeTestFile(t, filepath.Join(root, "a"), "old a\n")
+	writeTestFile(t, filepath.Join(root, "b"), "old b\n")
+
+	// interrupted before commit: staged files are discarded.
+	transaction, err := NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stageTestFile(
+		t, transaction, filepath.Join(root, "a"), BackupKindSSHKeys, "new a\n",
+	)
+
+	transaction.journal.Close()
+
+	err = RecoverTransaction(stateDir, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readTestFile(t, filepath.Join(root, "a")) != "old a\n" {
+		t.Fatal("uncommitted transaction should be rolled back")
+	}
+
+	if temporary := getTemporaryFiles(t, root); len(temporary) != 0 {
+		t.Fatalf("temporary files should be removed: %q", temporary)
+	}
+
+	// interrupted after the first file is installed: remaining files are
+	// installed.
+	transaction, err = NewTransaction(stateDir, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stageTestFile(
+		t, transaction, filepath.Join(root, "a"), BackupKindSSHKeys, "new a\n",
+	)
+	stageTestFile(
+		t, transaction, filepath.Join(root, "b"), BackupKindSSHKeys, "new b\n",
+	)
+
+	err = transaction.record(transactionRecord{Commit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.files[0].install()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction.journal.Close()
+
+	if readTestFile(t, filepath.Join(root, "b")) != "old b\n" {
+		t.Fatal("second file should not be installed yet")
+	}
+
+	err = RecoverTransaction(stateDir, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readTestFile(t, filepath.Join(root, "a")) != "new a\n" ||
+		readTestFile(t, filepath.Join(root, "b")) != "new b\n" {
+		t.Fatal("committed transaction should be completed")
+	}
+
+	_, err = os.Stat(filepath.Join(stateDir, transactionJournalName))
+	if !os.IsNotExist(err) {
+		t.Fatal("journal should be removed after recovery")
+	}
+
+	// nothing to recover.
+	err = RecoverTransaction(stateDir, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}